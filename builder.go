@@ -0,0 +1,153 @@
+package peg
+
+/*
+An Expr is a parsing expression that can be added to a Tree using
+AddDefinition. Exprs are composed using the functions below,
+which translate into the same sequence of Add... method calls
+a grammar parser would issue, e.g.
+
+	t.AddDefinition("Identifier",
+		Seq(Begin(), Ref("IdentStart"), Star(Ref("IdentCont")), End(), Ref("Spacing")))
+
+Strings and classes are specified in their escaped form as used
+within grammar files, without quotes or brackets.
+*/
+type Expr func(t *Tree) error
+
+// AddDefinition adds a rule named name that is defined by e.
+func (t *Tree) AddDefinition(name string, e Expr) error {
+	t.AddRule(name)
+	if err := e(t); err != nil {
+		return err
+	}
+	return t.AddExpression()
+}
+
+// AddKeywordSet declares the keywords kw, like the directive
+// `%keywords ident word 'if' 'else'`, adding a rule named ident,
+// which matches a word that is not a keyword; see AddKeywords.
+// Within expressions, the identifiers are referred to as Ref(ident),
+// the keywords as Keyword(kw).
+func (t *Tree) AddKeywordSet(ident, word string, kw ...string) error {
+	t.AddKeywords(ident)
+	if err := t.SetWordRule(word); err != nil {
+		return err
+	}
+	for _, s := range kw {
+		if err := t.AddKeyword(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddTypedDefinition is like AddDefinition, but also sets
+// the type of the rule's semantic value.
+func (t *Tree) AddTypedDefinition(name, typ string, e Expr) error {
+	t.AddRule(name)
+	t.AddRuleType(typ)
+	if err := e(t); err != nil {
+		return err
+	}
+	return t.AddExpression()
+}
+
+func nary(e []Expr, add func(t *Tree) error) Expr {
+	if len(e) == 0 {
+		return Nil()
+	}
+	return func(t *Tree) error {
+		if err := e[0](t); err != nil {
+			return err
+		}
+		for _, x := range e[1:] {
+			if err := x(t); err != nil {
+				return err
+			}
+			if err := add(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Seq matches each of its arguments in turn.
+func Seq(e ...Expr) Expr { return nary(e, (*Tree).AddSequence) }
+
+// Alt is an ordered choice between its arguments.
+func Alt(e ...Expr) Expr { return nary(e, (*Tree).AddAlternate) }
+
+func unary(e Expr, add func(t *Tree) error) Expr {
+	return func(t *Tree) error {
+		if err := e(t); err != nil {
+			return err
+		}
+		return add(t)
+	}
+}
+
+func leaf(add func(t *Tree)) Expr {
+	return func(t *Tree) error {
+		add(t)
+		return nil
+	}
+}
+
+func And(e Expr) Expr   { return unary(e, (*Tree).AddPeekFor) }
+func Not(e Expr) Expr   { return unary(e, (*Tree).AddPeekNot) }
+func Query(e Expr) Expr { return unary(e, (*Tree).AddQuery) }
+func Star(e Expr) Expr  { return unary(e, (*Tree).AddStar) }
+func Plus(e Expr) Expr  { return unary(e, (*Tree).AddPlus) }
+
+// Ref refers to the rule named rule.
+func Ref(rule string) Expr {
+	return leaf(func(t *Tree) { t.AddName(rule) })
+}
+
+// Var refers to the rule named rule, binding
+// its semantic value to variable name.
+func Var(name, rule string) Expr {
+	return leaf(func(t *Tree) {
+		t.AddVariable(name)
+		t.AddName(rule)
+	})
+}
+
+func Lit(s string) Expr {
+	return leaf(func(t *Tree) { t.AddString(s) })
+}
+
+// Keyword matches kw, which must have been declared using
+// AddKeywordSet, only if the word rule matches kw exactly.
+// It corresponds to a keyword literal like `if` within a grammar.
+func Keyword(kw string) Expr {
+	return leaf(func(t *Tree) { t.AddKeywordLiteral(kw) })
+}
+
+func Class(s string) Expr {
+	return leaf(func(t *Tree) { t.AddClass(s) })
+}
+
+// Pred is a semantic predicate, &{ code }.
+func Pred(code string) Expr {
+	return leaf(func(t *Tree) { t.AddPredicate(code) })
+}
+
+// Act is an action, { code }.
+func Act(code string) Expr {
+	return leaf(func(t *Tree) { t.AddAction(code) })
+}
+
+// Capture is a named capture, <@name: e>, which stores
+// the text matched by e into variable name.
+func Capture(name string, e Expr) Expr {
+	return Seq(leaf(func(t *Tree) { t.AddNamedBegin(name) }), e, End())
+}
+
+func Dot() Expr    { return leaf((*Tree).AddDot) }
+func Begin() Expr  { return leaf((*Tree).AddBegin) }
+func End() Expr    { return leaf((*Tree).AddEnd) }
+func Commit() Expr { return leaf((*Tree).AddCommit) }
+func Cut() Expr    { return leaf((*Tree).AddCut) }
+func Nil() Expr    { return leaf((*Tree).AddNil) }
@@ -0,0 +1,71 @@
+package peg
+
+import "fmt"
+
+// A Diagnostic describes a problem of a grammar found by Check.
+type Diagnostic struct {
+	Node    Node // the rule, or the name referring to a rule; nil if unknown
+	Offset  int  // the offset of Node within the source, -1 if unknown
+	Message string
+	Error   bool // whether the problem prevents a working parser, otherwise it is a warning
+}
+
+// Check resolves the rules of t, and reports rules that are used but
+// not defined, defined more than once, not used, or possibly left
+// recursive, keyword literals whose keywords have not been declared,
+// and errors found while the rules were added or resolved, like
+// variables bound to rules of different types.
+// The warnings Compile would print are not printed.
+func (t *Tree) Check() (diags []Diagnostic) {
+	add := func(node Node, isError bool, format string, a ...interface{}) {
+		d := Diagnostic{Node: node, Offset: -1, Message: fmt.Sprintf(format, a...), Error: isError}
+		if node != nil {
+			if offset, ok := t.offsets[node]; ok {
+				d.Offset = offset
+			}
+		}
+		diags = append(diags, d)
+	}
+	for _, k := range t.undeclaredKeywords() {
+		add(k, true, "keyword '%s' not declared using %%keywords", k.string)
+	}
+
+	var warnings []string
+	t.warnings = &warnings
+	defer func() { t.warnings = nil }()
+	t.resolve()
+	if t.err != nil {
+		add(nil, true, "%v", t.err)
+	}
+
+	defined := make(map[string]bool)
+	recursive := make(map[string]bool)
+	for _, name := range t.leftRecursive {
+		recursive[name] = true
+	}
+	for i, r := range t.Rules() {
+		name := r.String()
+		if r.GetExpression() == nilNode {
+			continue
+		}
+		switch {
+		case defined[name]:
+			add(r, true, "rule '%s' defined more than once", name)
+		case i > 0 && t.rulesCount[name] == 0:
+			add(r, false, "rule '%s' defined but not used", name)
+		}
+		if recursive[name] {
+			add(r, false, "possible infinite left recursion in rule '%s'", name)
+		}
+		defined[name] = true
+		Walk(r.GetExpression(), func(node Node) {
+			switch node.GetType() {
+			case TypeName, TypeIdent:
+				if t.rules[node.String()].GetExpression() == nilNode {
+					add(node, true, "rule '%v' used but not defined", node)
+				}
+			}
+		})
+	}
+	return
+}
@@ -0,0 +1,131 @@
+package peg
+
+// clone returns a copy of the tree as built by the Add* methods, which
+// can be compiled without affecting t, as compiling rewrites the
+// expressions of the rules. The tokens shared by all trees, like dot
+// or begin, remain shared, as they are compared by identity.
+func (t *Tree) clone() *Tree {
+	c := *t
+	c.rules = make(map[string]*rule, len(t.rules))
+	c.rulesCount = make(map[string]uint)
+	c.ruleList.Init()
+	c.Actions = make([]*action, len(t.Actions))
+	c.Classes = make(map[string]classEntry, len(t.Classes))
+	c.defines = make(map[string]string, len(t.defines))
+	c.switchExcl = make(map[string]bool, len(t.switchExcl))
+	c.Headers = append([]string(nil), t.Headers...)
+	c.trailers = append([]string(nil), t.trailers...)
+	c.longest = append([]string(nil), t.longest...)
+	c.tests = append([]*TestCase(nil), t.tests...)
+	c.keywords = append([]*keywordSet(nil), t.keywords...)
+	c.dispatch, c.skipping, c.dispatchTables, c.tries = nil, nil, nil, nil
+	c.valueTypes, c.leftRecursive, c.stack, c.varp = nil, nil, nil, nil
+	c.cover = nil
+	for k, v := range t.defines {
+		c.defines[k] = v
+	}
+	for k, v := range t.Classes {
+		c.Classes[k] = v
+	}
+	for k, v := range t.switchExcl {
+		c.switchExcl[k] = v
+	}
+
+	rules := make(map[*rule]*rule)
+	variables := make(map[*variable]*variable)
+	cloneRule := func(r *rule) *rule {
+		if cr, ok := rules[r]; ok {
+			return cr
+		}
+		cr := &rule{name: r.name, id: r.id, expression: r.expression,
+			hasActions: r.hasActions, typ: r.typ, helper: r.helper}
+		for _, v := range r.variables {
+			cv := *v
+			variables[v] = &cv
+			cr.variables = append(cr.variables, &cv)
+		}
+		rules[r] = cr
+		return cr
+	}
+	for element := t.ruleList.Front(); element != nil; element = element.Next() {
+		c.ruleList.PushBack(cloneRule(element.Value.(*rule)))
+	}
+	for name, r := range t.rules {
+		c.rules[name] = cloneRule(r)
+	}
+	for i, a := range t.Actions {
+		ca := *a
+		if a.rule != nil {
+			ca.rule = cloneRule(a.rule)
+		}
+		c.Actions[i] = &ca
+	}
+	actions := make(map[*action]*action, len(t.Actions))
+	for i, a := range t.Actions {
+		actions[a] = c.Actions[i]
+	}
+
+	nodes := make(map[Node]Node)
+	var cloneNode func(node Node) Node
+	cloneNode = func(node Node) (cn Node) {
+		if cn, ok := nodes[node]; ok {
+			return cn
+		}
+		switch x := node.(type) {
+		case *rule:
+			cn = cloneRule(x)
+		case *action:
+			cn = actions[x]
+		case *name:
+			cn = &name{Type: x.Type, string: x.string, varp: variables[x.varp]}
+		case *token:
+			switch x {
+			case dot, begin, end, commit, cut, nilNode:
+				return x
+			}
+			ct := *x
+			if x.class != nil {
+				ct.class = x.class.copy()
+			}
+			cn = &ct
+		case *keyword:
+			ck := *x
+			cn = &ck
+		case *namedBegin:
+			cb := *x
+			cn = &cb
+		case *nodeList:
+			l := &nodeList{Type: x.Type}
+			for element := x.front(); element != nil; element = element.Next() {
+				l.pushBack(cloneNode(element.Value.(Node)))
+			}
+			cn = l
+		default:
+			return node
+		}
+		nodes[node] = cn
+		return cn
+	}
+	for _, cr := range rules {
+		if cr.expression != nil {
+			cr.expression = cloneNode(cr.expression)
+		}
+	}
+	if t.offsets != nil {
+		c.offsets = make(map[Node]int, len(t.offsets))
+		for node, offset := range t.offsets {
+			switch x := node.(type) {
+			case *rule:
+				node = cloneRule(x)
+			case *action:
+				node = actions[x]
+			default:
+				if cn, ok := nodes[node]; ok {
+					node = cn
+				}
+			}
+			c.offsets[node] = offset
+		}
+	}
+	return &c
+}
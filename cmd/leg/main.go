@@ -19,6 +19,14 @@ var (
 	inline    = flag.Bool("inline", false, "parse rule inlining")
 	_switch   = flag.Bool("switch", false, "replace if-else if-else like blocks with switch blocks")
 	optiFlags = flag.String("O", "", "turn on various optimizations")
+	vm        = flag.Bool("vm", false, "generate a program for the parsing machine instead of Go functions")
+	bytes     = flag.Bool("bytes", false, "generate a parser for []byte input, passing yytext as []byte")
+	fuzz      = flag.String("fuzz", "", "write a fuzz test for the parser to `file`")
+	generate  = flag.Int("generate", 0, "print `n` random sentences of the grammar, quoted, instead of compiling it")
+	startRule = flag.String("rule", "", "the rule to generate sentences of (default the first rule)")
+	seed      = flag.Int64("seed", 0, "the seed for generating sentences (default the current time)")
+	cover     = flag.Bool("cover", false, "generate a parser counting the matches of rules, alternatives, and repetitions")
+	coverRep  = flag.String("coverreport", "", "annotate the grammar with the counts of the coverage profile `file`, instead of compiling it")
 )
 
 func main() {
@@ -26,12 +34,14 @@ func main() {
 	flag.BoolVar(&peg.Verbose, "verbose", false, "enable additional output, like statistics")
 	flag.Parse()
 
-	if flag.NArg() != 1 {
+	test := flag.NArg() == 2 && flag.Arg(0) == "test"
+	if flag.NArg() != 1 && !test {
 		flag.Usage()
 		fmt.Fprintf(os.Stderr, "  FILE: the leg file to compile\n")
+		fmt.Fprintf(os.Stderr, "  test FILE: run the test cases of the leg file\n")
 		os.Exit(1)
 	}
-	file := flag.Arg(0)
+	file := flag.Arg(flag.NArg() - 1)
 
 	buffer, err := ioutil.ReadFile(file)
 	if err != nil {
@@ -39,11 +49,63 @@ func main() {
 	}
 	p := &Leg{Tree: peg.New(*inline, *_switch), Buffer: string(buffer)}
 	p.Init()
+	if *coverRep != "" {
+		p.SetOffsetFunc(func() int {
+			b, _ := p.TextSpan()
+			return b.Offset
+		})
+	}
 	if err = p.Parse(0); err == nil {
+		err = p.Err()
+	}
+	if err == nil {
+		if test {
+			ok, err := p.ReportTests(os.Stdout, file, *optiFlags)
+			if err != nil {
+				log.Fatal(file, ": ", err)
+			}
+			if !ok {
+				os.Exit(1)
+			}
+			return
+		}
+		if *generate > 0 {
+			if err = p.WriteSentences(os.Stdout, *startRule, *generate, *seed); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		if *coverRep != "" {
+			if err = p.WriteCoverReportFile(os.Stdout, string(buffer), *coverRep); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		if *bytes {
+			p.Define("bytes", "1")
+		}
+		if *cover {
+			p.Define("cover", "1")
+		}
 		w := bufio.NewWriter(os.Stdout)
-		p.Compile(w, *optiFlags)
+		if *vm {
+			err = p.CompileVM(w)
+		} else {
+			err = p.Compile(w, *optiFlags)
+		}
+		if err != nil {
+			log.Fatal(file, ": ", err)
+		}
 		w.Flush()
+		if *fuzz != "" {
+			if err = p.WriteFuzz(*fuzz); err != nil {
+				log.Fatal(err)
+			}
+		}
 	} else {
 		log.Print(file, ":", err)
+		if e, ok := err.(*ParseError); ok {
+			fmt.Fprintln(os.Stderr, e.Excerpt())
+		}
 	}
 }
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/knieriem/peg"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// The language server of `peg lsp', which speaks the Language Server
+// Protocol over stdin and stdout. Grammars of both dialects are
+// parsed using peg.LoadTree; the offsets of rule definitions and of
+// names recorded within the Tree are used to answer requests.
+
+type lspServer struct {
+	in       *bufio.Reader
+	out      io.Writer
+	docs     map[string]*lspDoc
+	shutdown bool
+}
+
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	lspMethodNotFound = -32601
+	lspInvalidParams  = -32602
+	lspRequestFailed  = -32803
+)
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"` // in UTF-16 code units
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspDocPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+// An lspDoc is an open grammar.
+type lspDoc struct {
+	uri     string
+	text    string
+	tree    *peg.Tree
+	diags   []lspDiagnostic
+	symbols []lspSymbol // sorted by offset
+}
+
+// An lspSymbol is the definition of a rule, or a name referring to it.
+type lspSymbol struct {
+	name   string
+	offset int
+	def    bool
+}
+
+func runLSP() {
+	log.SetPrefix("peg lsp: ")
+	s := &lspServer{in: bufio.NewReader(os.Stdin), out: os.Stdout, docs: make(map[string]*lspDoc)}
+	for {
+		m, err := s.read()
+		if err == io.EOF {
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if m.Method == "exit" {
+			if s.shutdown {
+				os.Exit(0)
+			}
+			os.Exit(1)
+		}
+		result, rerr := s.handle(m)
+		if m.ID == nil {
+			if rerr != nil {
+				log.Print(m.Method, ": ", rerr.Message)
+			}
+			continue
+		}
+		reply := &lspMessage{JSONRPC: "2.0", ID: m.ID, Error: rerr}
+		if rerr == nil {
+			reply.Result = json.RawMessage("null")
+			if result != nil {
+				reply.Result = result
+			}
+		}
+		if err = s.write(reply); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// read reads a message, which is preceded by a header
+// containing its length.
+func (s *lspServer) read() (*lspMessage, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if v := strings.TrimPrefix(line, "Content-Length:"); v != line {
+			if length, err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+				return nil, fmt.Errorf("bad header: %s", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("missing Content-Length")
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(s.in, buf); err != nil {
+		return nil, err
+	}
+	m := new(lspMessage)
+	if err := json.Unmarshal(buf, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *lspServer) write(m *lspMessage) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(buf), buf)
+	return err
+}
+
+func (s *lspServer) notify(method string, params interface{}) {
+	buf, err := json.Marshal(params)
+	if err == nil {
+		err = s.write(&lspMessage{JSONRPC: "2.0", Method: method, Params: buf})
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *lspServer) handle(m *lspMessage) (interface{}, *lspError) {
+	switch m.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   1, // full documents
+				"definitionProvider": true,
+				"referencesProvider": true,
+				"renameProvider":     true,
+				"hoverProvider":      true,
+			},
+			"serverInfo": map[string]string{"name": "peg"},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(m.Params, &p); err != nil {
+			return nil, &lspError{lspInvalidParams, err.Error()}
+		}
+		s.update(p.TextDocument.URI, p.TextDocument.Text)
+	case "textDocument/didChange":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(m.Params, &p); err != nil {
+			return nil, &lspError{lspInvalidParams, err.Error()}
+		}
+		if n := len(p.ContentChanges); n != 0 {
+			s.update(p.TextDocument.URI, p.ContentChanges[n-1].Text)
+		}
+	case "textDocument/didClose":
+		var p lspDocPosition
+		if err := json.Unmarshal(m.Params, &p); err != nil {
+			return nil, &lspError{lspInvalidParams, err.Error()}
+		}
+		delete(s.docs, p.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+			"uri":         p.TextDocument.URI,
+			"diagnostics": []lspDiagnostic{},
+		})
+	case "textDocument/definition", "textDocument/references", "textDocument/hover", "textDocument/rename":
+		var p struct {
+			lspDocPosition
+			NewName string `json:"newName"`
+			Context struct {
+				IncludeDeclaration bool `json:"includeDeclaration"`
+			} `json:"context"`
+		}
+		if err := json.Unmarshal(m.Params, &p); err != nil {
+			return nil, &lspError{lspInvalidParams, err.Error()}
+		}
+		d := s.docs[p.TextDocument.URI]
+		if d == nil {
+			return nil, &lspError{lspRequestFailed, "unknown document: " + p.TextDocument.URI}
+		}
+		sym := d.symbolAt(d.offset(p.Position))
+		if sym == nil {
+			return nil, nil
+		}
+		switch m.Method {
+		case "textDocument/definition":
+			return d.locations(sym.name, true, false), nil
+		case "textDocument/references":
+			return d.locations(sym.name, p.Context.IncludeDeclaration, true), nil
+		case "textDocument/hover":
+			return d.hover(sym), nil
+		default:
+			return d.rename(sym.name, p.NewName)
+		}
+	default:
+		if m.ID != nil {
+			return nil, &lspError{lspMethodNotFound, "method not supported: " + m.Method}
+		}
+	}
+	return nil, nil
+}
+
+// update parses the new text of a document, and publishes its diagnostics.
+func (s *lspServer) update(uri, text string) {
+	d := &lspDoc{uri: uri, text: text}
+	d.load()
+	s.docs[uri] = d
+	s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri":         uri,
+		"diagnostics": d.diags,
+	})
+}
+
+func (d *lspDoc) load() {
+	d.diags = []lspDiagnostic{}
+	t, err := peg.LoadTree(d.text)
+	if e, ok := err.(*peg.ParseError); ok {
+		d.diag(e.Offset, 1, true, e.Error())
+	} else if err != nil {
+		d.diag(0, 0, true, err.Error())
+	}
+	if t == nil {
+		return
+	}
+	d.tree = t
+	for _, diag := range t.Check() {
+		n := 0
+		if diag.Node != nil {
+			n = len(diag.Node.String())
+		}
+		d.diag(diag.Offset, n, diag.Error, diag.Message)
+	}
+	d.symbols = symbols(t)
+}
+
+// symbols returns the definitions of rules, and the names
+// referring to them, whose offsets are known.
+func symbols(t *peg.Tree) (syms []lspSymbol) {
+	for _, r := range t.Rules() {
+		if offset, ok := t.Offset(r); ok {
+			syms = append(syms, lspSymbol{name: r.String(), offset: offset, def: true})
+		}
+		peg.Walk(r.GetExpression(), func(node peg.Node) {
+			switch node.GetType() {
+			case peg.TypeName, peg.TypeIdent:
+				if offset, ok := t.Offset(node); ok {
+					syms = append(syms, lspSymbol{name: node.String(), offset: offset})
+				}
+			}
+		})
+	}
+	sort.Slice(syms, func(i, j int) bool { return syms[i].offset < syms[j].offset })
+	return
+}
+
+func (d *lspDoc) diag(offset, n int, isError bool, msg string) {
+	if offset < 0 {
+		offset, n = 0, 0
+	}
+	severity := 2 // warning
+	if isError {
+		severity = 1
+	}
+	d.diags = append(d.diags, lspDiagnostic{Range: d.span(offset, n), Severity: severity, Source: "peg", Message: msg})
+}
+
+// position converts an offset into an LSP position,
+// whose characters count UTF-16 code units.
+func (d *lspDoc) position(offset int) (p lspPosition) {
+	pos := peg.PositionOf(d.text, offset)
+	p.Line = pos.Line - 1
+	begin := strings.LastIndexByte(d.text[:pos.Offset], '\n') + 1
+	for _, r := range d.text[begin:pos.Offset] {
+		p.Character += len(utf16.Encode([]rune{r}))
+	}
+	return
+}
+
+// offset converts an LSP position into an offset.
+func (d *lspDoc) offset(p lspPosition) int {
+	offset := 0
+	for i := 0; i < p.Line; i++ {
+		j := strings.IndexByte(d.text[offset:], '\n')
+		if j < 0 {
+			return len(d.text)
+		}
+		offset += j + 1
+	}
+	for n := 0; n < p.Character && offset < len(d.text) && d.text[offset] != '\n'; {
+		r, size := utf8.DecodeRuneInString(d.text[offset:])
+		n += len(utf16.Encode([]rune{r}))
+		offset += size
+	}
+	return offset
+}
+
+func (d *lspDoc) span(offset, n int) lspRange {
+	return lspRange{d.position(offset), d.position(offset + n)}
+}
+
+func (d *lspDoc) symbolAt(offset int) *lspSymbol {
+	for i := range d.symbols {
+		if sym := &d.symbols[i]; offset >= sym.offset && offset <= sym.offset+len(sym.name) {
+			return sym
+		}
+	}
+	return nil
+}
+
+func (d *lspDoc) locations(name string, defs, refs bool) []lspLocation {
+	locs := []lspLocation{}
+	for _, sym := range d.symbols {
+		if sym.name == name && (sym.def && defs || !sym.def && refs) {
+			locs = append(locs, lspLocation{d.uri, d.span(sym.offset, len(name))})
+		}
+	}
+	return locs
+}
+
+func (d *lspDoc) hover(sym *lspSymbol) interface{} {
+	r := d.tree.Rule(sym.name)
+	if r == nil || r.GetExpression().GetType() == peg.TypeNil {
+		return nil
+	}
+	text := peg.Format(r)
+	if typ := r.ValueType(); typ != "" {
+		text += "\n\n(value of type " + typ + ")"
+	}
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": "```\n" + text + "\n```"},
+		"range":    d.span(sym.offset, len(sym.name)),
+	}
+}
+
+// rename replaces the definition of a rule and all references to it.
+// The new name is accepted if the grammar can still be parsed, with
+// the new name at the places of the old one, and if it has not been
+// used yet.
+func (d *lspDoc) rename(name, newName string) (interface{}, *lspError) {
+	for _, sym := range d.symbols {
+		if sym.name == newName {
+			return nil, &lspError{lspRequestFailed, "rule '" + newName + "' exists already"}
+		}
+	}
+	var b strings.Builder
+	var edits []lspTextEdit
+	pos := 0
+	for _, sym := range d.symbols {
+		if sym.name == name {
+			b.WriteString(d.text[pos:sym.offset])
+			b.WriteString(newName)
+			pos = sym.offset + len(name)
+			edits = append(edits, lspTextEdit{d.span(sym.offset, len(name)), newName})
+		}
+	}
+	b.WriteString(d.text[pos:])
+	t, err := peg.LoadTree(b.String())
+	n := 0
+	if err == nil {
+		for _, sym := range symbols(t) {
+			if sym.name == newName {
+				n++
+			}
+		}
+	}
+	if n != len(edits) {
+		return nil, &lspError{lspRequestFailed, "invalid rule name: " + newName}
+	}
+	return map[string]interface{}{
+		"changes": map[string][]lspTextEdit{d.uri: edits},
+	}, nil
+}
@@ -12,25 +12,53 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 var (
 	inline    = flag.Bool("inline", false, "parse rule inlining")
 	_switch   = flag.Bool("switch", false, "replace if-else if-else like blocks with switch blocks")
 	optiFlags = flag.String("O", "", "turn on various optimizations")
+	vm        = flag.Bool("vm", false, "generate a program for the parsing machine instead of Go functions")
+	bytes     = flag.Bool("bytes", false, "generate a parser for []byte input, passing yytext as []byte")
+	fuzz      = flag.String("fuzz", "", "write a fuzz test for the parser to `file`")
+	generate  = flag.Int("generate", 0, "print `n` random sentences of the grammar, quoted, instead of compiling it")
+	startRule = flag.String("rule", "", "the rule to generate sentences of (default the first rule)")
+	seed      = flag.Int64("seed", 0, "the seed for generating sentences (default the current time)")
+	cover     = flag.Bool("cover", false, "generate a parser counting the matches of rules, alternatives, and repetitions")
+	coverRep  = flag.String("coverreport", "", "annotate the grammar with the counts of the coverage profile `file`, instead of compiling it")
 )
 
 func main() {
 	runtime.GOMAXPROCS(2)
+	flag.BoolVar(&peg.Verbose, "verbose", false, "enable additional output, like statistics")
 	flag.Parse()
 
-	if flag.NArg() != 1 {
+	if flag.NArg() == 2 && flag.Arg(0) == "repl" {
+		runREPL(flag.Arg(1))
+		return
+	}
+	if flag.NArg() == 1 && flag.Arg(0) == "lsp" {
+		runLSP()
+	}
+	if flag.NArg() == 3 && flag.Arg(0) == "highlight" {
+		writeHighlighting(flag.Arg(1), flag.Arg(2))
+		return
+	}
+	test := flag.NArg() == 2 && flag.Arg(0) == "test"
+	if flag.NArg() != 1 && !test {
 		flag.Usage()
 		fmt.Fprintf(os.Stderr, "  FILE: the peg file to compile\n")
+		fmt.Fprintf(os.Stderr, "  test FILE: run the test cases of the peg file\n")
+		fmt.Fprintf(os.Stderr, "  repl FILE: parse lines typed in using the peg or leg file\n")
+		fmt.Fprintf(os.Stderr, "  lsp: run a language server for peg and leg files on stdin and stdout\n")
+		fmt.Fprintf(os.Stderr, "  highlight FORMAT DIR: write syntax highlighting definitions for peg and leg files to DIR;\n")
+		fmt.Fprintf(os.Stderr, "\tFORMAT is %s\n", strings.Join(peg.HighlightFormats, " or "))
 		os.Exit(1)
 	}
-	file := flag.Arg(0)
+	file := flag.Arg(flag.NArg() - 1)
 
 	buffer, err := ioutil.ReadFile(file)
 	if err != nil {
@@ -38,11 +66,81 @@ func main() {
 	}
 	p := &Peg{Tree: peg.New(*inline, *_switch), Buffer: string(buffer)}
 	p.Init()
+	if *coverRep != "" {
+		p.SetOffsetFunc(func() int {
+			b, _ := p.TextSpan()
+			return b.Offset
+		})
+	}
 	if err = p.Parse(0); err == nil {
+		err = p.Err()
+	}
+	if err == nil {
+		if test {
+			ok, err := p.ReportTests(os.Stdout, file, *optiFlags)
+			if err != nil {
+				log.Fatal(file, ": ", err)
+			}
+			if !ok {
+				os.Exit(1)
+			}
+			return
+		}
+		if *generate > 0 {
+			if err = p.WriteSentences(os.Stdout, *startRule, *generate, *seed); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		if *coverRep != "" {
+			if err = p.WriteCoverReportFile(os.Stdout, string(buffer), *coverRep); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		if *bytes {
+			p.Define("bytes", "1")
+		}
+		if *cover {
+			p.Define("cover", "1")
+		}
 		w := bufio.NewWriter(os.Stdout)
-		p.Compile(w, *optiFlags)
+		if *vm {
+			err = p.CompileVM(w)
+		} else {
+			err = p.Compile(w, *optiFlags)
+		}
+		if err != nil {
+			log.Fatal(file, ": ", err)
+		}
 		w.Flush()
+		if *fuzz != "" {
+			if err = p.WriteFuzz(*fuzz); err != nil {
+				log.Fatal(err)
+			}
+		}
 	} else {
 		log.Print(file, ":", err)
+		if e, ok := err.(*ParseError); ok {
+			fmt.Fprintln(os.Stderr, e.Excerpt())
+		}
+	}
+}
+
+func writeHighlighting(format, dir string) {
+	for _, dialect := range []string{"peg", "leg"} {
+		files, err := peg.Highlighting(format, dialect)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for name, b := range files {
+			file := filepath.Join(dir, filepath.FromSlash(name))
+			if err = os.MkdirAll(filepath.Dir(file), 0777); err == nil {
+				err = ioutil.WriteFile(file, b, 0666)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/knieriem/peg"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const replHelp = `Lines not starting with ':' are parsed using the current rule;
+a line starting with '"' or '` + "`" + `' is unquoted first, like a Go string.
+	:rules		list the rules of the grammar
+	:rule NAME	select the rule to parse with, by name or number
+	:tree		toggle printing of parse trees
+	:trace		toggle printing of rule calls
+	:reload		load the grammar again
+	:quit		leave
+The grammar is loaded again when its file changes.
+`
+
+// maxTraceLines limits the number of rule calls printed.
+const maxTraceLines = 500
+
+// A repl parses lines read from the terminal using a grammar
+// loaded with peg.Load, without compiling it.
+type repl struct {
+	file    string
+	modTime time.Time
+	g       *peg.Grammar
+	names   []string // by rule id
+	rule    string
+	tree    bool
+	trace   bool
+}
+
+func runREPL(file string) {
+	r := &repl{file: file, tree: true}
+	r.load()
+	fmt.Print("Type :help for help.\n")
+	in := bufio.NewScanner(os.Stdin)
+	for r.prompt(); in.Scan(); r.prompt() {
+		if fi, err := os.Stat(r.file); err == nil && !fi.ModTime().Equal(r.modTime) {
+			r.load()
+		}
+		line := in.Text()
+		if strings.HasPrefix(line, ":") {
+			if !r.command(strings.Fields(line[1:])) {
+				return
+			}
+			continue
+		}
+		if strings.HasPrefix(line, `"`) || strings.HasPrefix(line, "`") {
+			s, err := strconv.Unquote(line)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			line = s
+		}
+		r.parse(line)
+	}
+	fmt.Println()
+}
+
+func (r *repl) prompt() {
+	fmt.Printf("%s> ", r.rule)
+}
+
+// load loads the grammar. If it contains errors, the
+// previous version is kept.
+func (r *repl) load() {
+	fi, err := os.Stat(r.file)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	r.modTime = fi.ModTime()
+	src, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	g, err := peg.Load(string(src))
+	if err != nil {
+		fmt.Printf("%s: %v\n", r.file, err)
+		if r.g != nil {
+			fmt.Println("keeping the previous version of the grammar")
+		}
+		return
+	}
+	for _, w := range g.Warnings {
+		fmt.Printf("%s: %s\n", r.file, w)
+	}
+	r.g = g
+	r.names = r.names[:0]
+	keep := false
+	for _, rule := range g.Tree.Rules() {
+		r.names = append(r.names, rule.String())
+		keep = keep || rule.String() == r.rule
+	}
+	if !keep && len(r.names) != 0 {
+		r.rule = r.names[0]
+	}
+	fmt.Printf("loaded %s, %d rules\n", r.file, len(r.names))
+}
+
+// command executes a command line; it returns false if the
+// repl shall be left.
+func (r *repl) command(args []string) bool {
+	if len(args) == 0 {
+		args = []string{"help"}
+	}
+	switch args[0] {
+	case "q", "quit":
+		return false
+	case "rules":
+		for i, name := range r.names {
+			mark := " "
+			if name == r.rule {
+				mark = "*"
+			}
+			fmt.Printf("%s %3d %s\n", mark, i, name)
+		}
+	case "rule":
+		if len(args) != 2 {
+			fmt.Println("usage: :rule NAME")
+			break
+		}
+		name := args[1]
+		if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(r.names) {
+			name = r.names[i]
+		}
+		for _, n := range r.names {
+			if n == name {
+				r.rule = name
+				return true
+			}
+		}
+		fmt.Printf("no such rule: %s\n", name)
+	case "tree":
+		r.tree = !r.tree
+		fmt.Printf("parse trees %s\n", onOff(r.tree))
+	case "trace":
+		r.trace = !r.trace
+		fmt.Printf("rule trace %s\n", onOff(r.trace))
+	case "reload":
+		r.load()
+	default:
+		fmt.Print(replHelp)
+	}
+	return true
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+func (r *repl) parse(input string) {
+	if r.g == nil {
+		fmt.Println("no grammar loaded")
+		return
+	}
+	var tr *replTracer
+	var tracer peg.Tracer
+	if r.trace {
+		tr = new(replTracer)
+		tracer = tr
+	}
+	tree, err := r.g.ParseTrace(input, r.rule, tracer)
+	if tr != nil {
+		tr.print(r.names, input)
+	}
+	switch e := err.(type) {
+	case nil:
+		if tree.End == len(input) {
+			fmt.Println("match")
+		} else {
+			fmt.Printf("match up to %s, %d of %d bytes; left: %q\n",
+				peg.PositionOf(input, tree.End), tree.End, len(input), input[tree.End:])
+		}
+		if r.tree {
+			printTree(tree, "")
+		}
+	case *peg.ParseError:
+		fmt.Printf("no match, got as far as %s\n", e.Position)
+		fmt.Printf("\t%s\n", strings.Replace(e.Excerpt(), "\n", "\n\t", 1))
+	default:
+		fmt.Println(err)
+	}
+}
+
+func printTree(t *peg.ParseTree, indent string) {
+	text := t.Text
+	if len(text) > 40 {
+		text = text[:37] + "..."
+	}
+	fmt.Printf("%s%s %q\n", indent, t.Rule, text)
+	for _, c := range t.Children {
+		printTree(c, indent+"  ")
+	}
+}
+
+// A replTracer records the rule calls of a parse.
+type replTracer struct {
+	calls []replCall
+	stack []int
+}
+
+type replCall struct {
+	rule, depth int
+	begin, end  int
+	match       bool
+}
+
+func (t *replTracer) Enter(rule, position int) {
+	t.stack = append(t.stack, len(t.calls))
+	t.calls = append(t.calls, replCall{rule: rule, depth: len(t.stack) - 1, begin: position})
+}
+
+func (t *replTracer) Leave(rule, position int, match bool) {
+	c := &t.calls[t.stack[len(t.stack)-1]]
+	t.stack = t.stack[:len(t.stack)-1]
+	c.end, c.match = position, match
+}
+
+func (t *replTracer) print(names []string, input string) {
+	for i, c := range t.calls {
+		if i == maxTraceLines {
+			fmt.Printf("... %d more rule calls\n", len(t.calls)-i)
+			break
+		}
+		result := "fail at " + peg.PositionOf(input, c.end).String()
+		if c.match {
+			result = fmt.Sprintf("ok %q", input[c.begin:c.end])
+		}
+		fmt.Printf("%s%s %s: %s\n", strings.Repeat("  ", c.depth), names[c.rule], peg.PositionOf(input, c.begin), result)
+	}
+}
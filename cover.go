@@ -0,0 +1,168 @@
+package peg
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// coverPoints returns the nodes counted in coverage mode, which is
+// enabled by defining "cover", in the order of their counters: each
+// defined rule, followed by the alternatives and the repeated
+// expressions within it. Tokens like `.' and empty alternatives,
+// which are shared within a tree, are replaced by copies, so that
+// each occurrence gets its own counter.
+func (t *Tree) coverPoints() (points []Node) {
+	add := func(el *list.Element) {
+		x := el.Value.(Node)
+		switch x.GetType() {
+		case TypeNil, TypeDot, TypeCommit, TypeCut, TypeBegin, TypeEnd:
+			c := *x.(*token)
+			x = &c
+			el.Value = x
+		}
+		points = append(points, x)
+	}
+	var walk func(node Node)
+	walk = func(node Node) {
+		switch node.GetType() {
+		case TypeAlternate:
+			for el := node.(List).front(); el != nil; el = el.Next() {
+				add(el)
+				walk(el.Value.(Node))
+			}
+		case TypeQuery, TypeStar, TypePlus:
+			el := node.(List).front()
+			add(el)
+			walk(el.Value.(Node))
+		case TypeSequence, TypePeekFor, TypePeekNot:
+			for el := node.(List).front(); el != nil; el = el.Next() {
+				walk(el.Value.(Node))
+			}
+		}
+	}
+	for _, r := range t.Rules() {
+		if x := r.GetExpression(); x != nilNode {
+			points = append(points, r)
+			walk(x)
+		}
+	}
+	return
+}
+
+// offsetOf returns the offset of node within the source of the
+// grammar, which is the offset of its first leaf that has one.
+func (t *Tree) offsetOf(node Node) (offset int, ok bool) {
+	if offset, ok = t.offsets[node]; ok {
+		return
+	}
+	switch node.GetType() {
+	case TypeAlternate, TypeSequence, TypeQuery, TypeStar, TypePlus, TypePeekFor, TypePeekNot:
+		for el := node.(List).front(); el != nil; el = el.Next() {
+			if offset, ok = t.offsetOf(el.Value.(Node)); ok {
+				return
+			}
+		}
+	}
+	return
+}
+
+// WriteCoverReport reads a coverage profile, as written by the function
+// WriteCoverProfile of a parser generated in coverage mode, and writes
+// src, the source of the grammar, to w, with the count of each rule,
+// alternative, and repeated expression inserted in front of it, like
+// `«3»'+' Product'. The offsets of the nodes must have been recorded
+// using SetOffsetFunc while the grammar was parsed.
+func (t *Tree) WriteCoverReport(w io.Writer, src string, profile io.Reader) error {
+	points := t.coverPoints()
+	counts, err := readCoverProfile(profile)
+	if err != nil {
+		return err
+	}
+	if len(counts) != len(points) {
+		return fmt.Errorf("peg: coverage profile has %d counters, the grammar %d", len(counts), len(points))
+	}
+
+	type mark struct {
+		offset int
+		count  uint64
+	}
+	var marks []mark
+	var ruleOffset int
+	covered := 0
+	for i, node := range points {
+		offset, ok := t.offsetOf(node)
+		if node.GetType() == TypeRule {
+			if !ok {
+				return fmt.Errorf("peg: position of rule '%v' unknown, missing SetOffsetFunc", node)
+			}
+			ruleOffset = offset
+		} else if !ok {
+			offset = ruleOffset
+		}
+		if offset > len(src) {
+			offset = len(src)
+		}
+		marks = append(marks, mark{offset, counts[i]})
+		if counts[i] != 0 {
+			covered++
+		}
+	}
+	sort.SliceStable(marks, func(i, j int) bool { return marks[i].offset < marks[j].offset })
+
+	b := bufio.NewWriter(w)
+	if len(points) != 0 {
+		fmt.Fprintf(b, "# coverage: %.1f%% of %d points matched\n", 100*float64(covered)/float64(len(points)), len(points))
+	}
+	pos := 0
+	for _, m := range marks {
+		b.WriteString(src[pos:m.offset])
+		fmt.Fprintf(b, "«%d»", m.count)
+		pos = m.offset
+	}
+	b.WriteString(src[pos:])
+	return b.Flush()
+}
+
+// WriteCoverReportFile is like WriteCoverReport, reading the
+// coverage profile from file.
+func (t *Tree) WriteCoverReportFile(w io.Writer, src, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = t.WriteCoverReport(w, src, f); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return nil
+}
+
+// readCoverProfile reads the counters of a coverage profile.
+func readCoverProfile(r io.Reader) (counts []uint64, err error) {
+	s := bufio.NewScanner(r)
+	var n int
+	if !s.Scan() {
+		err = s.Err()
+	} else if _, err = fmt.Sscanf(s.Text(), "peg coverage %d", &n); err != nil {
+		err = fmt.Errorf("peg: not a coverage profile: %v", err)
+	}
+	for err == nil && s.Scan() {
+		var c uint64
+		if c, err = strconv.ParseUint(s.Text(), 10, 64); err != nil {
+			err = fmt.Errorf("peg: coverage profile: %v", err)
+		}
+		counts = append(counts, c)
+	}
+	if err == nil {
+		err = s.Err()
+	}
+	if err == nil && len(counts) != n {
+		err = fmt.Errorf("peg: coverage profile: %d counters, want %d", len(counts), n)
+	}
+	return
+}
@@ -0,0 +1,99 @@
+package peg
+
+import (
+	"strconv"
+	"strings"
+)
+
+// maxCaseBytes is the number of bytes up to which the cases of a
+// switch on the next byte are listed; beyond that, a dispatch
+// table is used.
+const maxCaseBytes = 16
+
+// A dispatchGroup consists of the bytes for which the same
+// alternatives of an ordered choice may match.
+type dispatchGroup struct {
+	alternatives []int // the indices of the alternatives, in order
+	class        *characterClass
+}
+
+// dispatchGroups partitions the bytes that are in at least one of
+// the first sets of the alternatives of an ordered choice, given by
+// classes, into groups, in the order of their smallest byte.
+func dispatchGroups(classes []*characterClass) (groups []*dispatchGroup) {
+	byKey := make(map[string]*dispatchGroup)
+	for b := 0; b < 256; b++ {
+		var alternatives []int
+		var key []byte
+		for i, c := range classes {
+			if c.has(uint8(b)) {
+				alternatives = append(alternatives, i)
+				key = strconv.AppendInt(key, int64(i), 10)
+				key = append(key, ',')
+			}
+		}
+		if alternatives == nil {
+			continue
+		}
+		g, ok := byKey[string(key)]
+		if !ok {
+			g = &dispatchGroup{alternatives: alternatives, class: new(characterClass)}
+			byKey[string(key)] = g
+			groups = append(groups, g)
+		}
+		g.class.add(uint8(b))
+	}
+	return
+}
+
+// copies returns the number of alternatives within all groups.
+func copies(groups []*dispatchGroup) (n int) {
+	for _, g := range groups {
+		n += len(g.alternatives)
+	}
+	return
+}
+
+// dispatchTable returns the index of the table, within yyDispatch,
+// that maps each byte to the number of the case of an unordered
+// alternate, counting from 1, or to 0, if no case applies.
+func (t *Tree) dispatchTable(node Node) int {
+	if id, ok := t.dispatch[node]; ok {
+		return id
+	}
+	var table [256]byte
+	for i, x := range node.(List).Items() {
+		class := x.(List).front().Value.(List).front().Value.(Node).(Token).GetClass()
+		for b := 0; b < 256; b++ {
+			if class.has(uint8(b)) {
+				table[b] = byte(i + 1)
+			}
+		}
+	}
+	if t.dispatch == nil {
+		t.dispatch = make(map[Node]int)
+	}
+	id := len(t.dispatchTables)
+	t.dispatch[node] = id
+	t.dispatchTables = append(t.dispatchTables, string(table[:]))
+	return id
+}
+
+// quoteTable returns a dispatch table as a Go string literal,
+// split into lines of 32 bytes.
+func quoteTable(table string) string {
+	var b strings.Builder
+	for i := 0; i < len(table); i += 32 {
+		if i > 0 {
+			b.WriteString(" +\n\t\t")
+		}
+		b.WriteByte('"')
+		for _, c := range []byte(table[i : i+32]) {
+			b.WriteString(`\x`)
+			b.WriteString(strconv.FormatUint(uint64(c)>>4, 16))
+			b.WriteString(strconv.FormatUint(uint64(c)&15, 16))
+		}
+		b.WriteByte('"')
+	}
+	return b.String()
+}
@@ -0,0 +1,79 @@
+package peg
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+)
+
+/*
+CompileFuzz writes a test file for the parser written by Compile
+or CompileVM, containing a function FuzzParse for Go's fuzzing
+engine. FuzzParse applies each rule to its input, and fails if the
+parser panics, e.g. within an action, or does more work than the
+budget allows. The corpus is seeded with the grammar's examples,
+and with the inputs of its test cases.
+*/
+func (t *Tree) CompileFuzz(out io.Writer) {
+	w := bufio.NewWriter(out)
+	tpl := template.New("fuzz")
+	tpl.Funcs(template.FuncMap{
+		"def": func(key string) string { return t.defines[key] },
+		"pkg": t.packageName,
+		"seeds": func() (seeds []string) {
+			seen := make(map[string]bool)
+			for _, s := range t.examples {
+				if !seen[s] {
+					seen[s] = true
+					seeds = append(seeds, s)
+				}
+			}
+			for _, c := range t.tests {
+				if !seen[c.Input] {
+					seen[c.Input] = true
+					seeds = append(seeds, c.Input)
+				}
+			}
+			return
+		},
+	})
+	if _, err := tpl.Parse(fuzzTemplate); err != nil {
+		log.Fatal(err)
+	}
+	if err := tpl.Execute(w, t); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// WriteFuzz creates file, and writes the test written by CompileFuzz
+// to it.
+func (t *Tree) WriteFuzz(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	t.CompileFuzz(f)
+	return f.Close()
+}
+
+// packageName returns the name of the package of the generated
+// parser, as defined by a PE grammar, or by the header of an LE grammar.
+func (t *Tree) packageName() string {
+	if p := t.defines["package"]; p != "" {
+		return p
+	}
+	for _, h := range t.Headers {
+		for _, line := range strings.Split(h, "\n") {
+			if f := strings.Fields(line); len(f) >= 2 && f[0] == "package" {
+				return f[1]
+			}
+		}
+	}
+	return "main"
+}
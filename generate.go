@@ -0,0 +1,230 @@
+package peg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+/*
+A Generator produces random sentences of a grammar, which can be
+used as input for testing parsers. Alternatives and repetitions
+are chosen randomly; once MaxDepth nested rule calls are reached,
+the expansions that terminate soonest are preferred. Each sentence
+is checked using the parsing machine, so that sentences violating
+`!' and `&' predicates, or the ordered choice, are rejected and
+replaced by new ones. Semantic predicates are assumed to succeed.
+*/
+type Generator struct {
+	Rand      *rand.Rand
+	MaxDepth  int // the depth of rule calls beyond which expansions are kept small
+	MaxRepeat int // the maximum number of repetitions of `*' and `+'
+	Attempts  int // the number of candidates tried per sentence
+
+	t      *Tree
+	prog   *vmProgram
+	height map[Node]int // the minimal depth of rule calls needed to expand a node
+}
+
+const infiniteHeight = 1 << 30
+
+// NewGenerator returns a Generator for the grammar t, which
+// uses r as its source of random numbers.
+func NewGenerator(t *Tree, r *rand.Rand) (*Generator, error) {
+	if err := t.resolveForMachine(); err != nil {
+		return nil, err
+	}
+	g := &Generator{
+		Rand:      r,
+		MaxDepth:  12,
+		MaxRepeat: 3,
+		Attempts:  100,
+		t:         t,
+		prog:      t.compileProgram(false),
+		height:    make(map[Node]int),
+	}
+	g.computeHeights()
+	return g, nil
+}
+
+// computeHeights determines, for each rule, and each of the nodes
+// within its expression, the minimal depth of rule calls needed to
+// produce a sentence, by iterating until a fixed point is reached.
+func (g *Generator) computeHeights() {
+	var height func(node Node) int
+	height = func(node Node) (h int) {
+		switch node.GetType() {
+		case TypeName, TypeIdent:
+			h = infiniteHeight
+			if rh, ok := g.height[g.t.rules[node.String()]]; ok && rh < infiniteHeight {
+				h = rh + 1
+			}
+		case TypeSequence:
+			for el := node.(List).front(); el != nil; el = el.Next() {
+				if x := height(el.Value.(Node)); x > h {
+					h = x
+				}
+			}
+		case TypeAlternate, TypeUnorderedAlternate:
+			h = infiniteHeight
+			for _, x := range g.alternatives(node) {
+				if x := height(x); x < h {
+					h = x
+				}
+			}
+		case TypePlus:
+			h = height(node.(List).front().Value.(Node))
+		case TypeQuery, TypeStar, TypePeekFor, TypePeekNot:
+			height(node.(List).front().Value.(Node))
+		}
+		g.height[node] = h
+		return
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, r := range g.t.Rules() {
+			h := height(r.GetExpression())
+			if old, ok := g.height[r]; !ok || h < old {
+				g.height[r] = h
+				changed = true
+			}
+		}
+	}
+}
+
+// alternatives returns the choices of an alternate.
+func (g *Generator) alternatives(node Node) (choices []Node) {
+	for _, x := range node.(List).Items() {
+		if node.GetType() == TypeUnorderedAlternate {
+			// skip the class used by the switch statement
+			x = x.(List).front().Next().Value.(Node)
+		}
+		choices = append(choices, x)
+	}
+	return
+}
+
+// Generate returns a random sentence matched by rule.
+func (g *Generator) Generate(rule string) (string, error) {
+	r, ok := g.t.rules[rule]
+	if !ok {
+		return "", errors.New("peg: no such rule: " + rule)
+	}
+	if g.height[r] >= infiniteHeight {
+		return "", fmt.Errorf("peg: rule '%s' does not produce finite sentences", rule)
+	}
+	for i := 0; i < g.Attempts; i++ {
+		var b strings.Builder
+		g.expand(&b, r.GetExpression(), 0)
+		s := b.String()
+		var m Machine
+		if m.Run(&g.prog.Program, r.id, s, nopHost{}) && m.Position == len(s) {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("peg: no sentence of rule '%s' found in %d attempts", rule, g.Attempts)
+}
+
+// WriteSentences writes n random sentences of rule, or of the first
+// rule if rule is empty, to w, one per line, quoted as Go strings.
+// The sentences are generated using seed; if seed is 0, the current
+// time is used.
+func (t *Tree) WriteSentences(w io.Writer, rule string, n int, seed int64) error {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	g, err := NewGenerator(t, rand.New(rand.NewSource(seed)))
+	if err != nil {
+		return err
+	}
+	if rule == "" {
+		rule = t.Rules()[0].String()
+	}
+	bw := bufio.NewWriter(w)
+	for i := 0; i < n; i++ {
+		s, err := g.Generate(rule)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "%q\n", s)
+	}
+	return bw.Flush()
+}
+
+func (g *Generator) expand(b *strings.Builder, node Node, depth int) {
+	limited := depth >= g.MaxDepth
+	if t := node.GetType(); t == TypeQuery || t == TypeStar {
+		// avoid expansions that do not terminate
+		limited = limited || g.height[node.(List).front().Value.(Node)] >= infiniteHeight
+	}
+	repeat := func(min int) (n int) {
+		if limited || g.MaxRepeat <= min {
+			return min
+		}
+		return min + g.Rand.Intn(g.MaxRepeat-min+1)
+	}
+	switch node.GetType() {
+	case TypeDot:
+		b.WriteByte(byte(' ' + g.Rand.Intn('~'-' '+1)))
+	case TypeCharacter, TypeString:
+		b.WriteString(unescape(node.String()))
+	case TypeKeyword:
+		b.WriteString(node.String())
+	case TypeClass:
+		b.WriteByte(g.classMember(node.(Token).GetClass()))
+	case TypeName, TypeIdent:
+		g.expand(b, g.t.rules[node.String()].GetExpression(), depth+1)
+	case TypeSequence:
+		for el := node.(List).front(); el != nil; el = el.Next() {
+			g.expand(b, el.Value.(Node), depth)
+		}
+	case TypeAlternate, TypeUnorderedAlternate:
+		choices := g.alternatives(node)
+		x := choices[g.Rand.Intn(len(choices))]
+		if limited || g.height[x] >= infiniteHeight {
+			for _, c := range choices {
+				if g.height[c] < g.height[x] {
+					x = c
+				}
+			}
+		}
+		g.expand(b, x, depth)
+	case TypeQuery:
+		if !limited && g.Rand.Intn(2) == 0 {
+			g.expand(b, node.(List).front().Value.(Node), depth)
+		}
+	case TypeStar, TypePlus:
+		min := 0
+		if node.GetType() == TypePlus {
+			min = 1
+		}
+		for n := repeat(min); n > 0; n-- {
+			g.expand(b, node.(List).front().Value.(Node), depth)
+		}
+	}
+}
+
+// classMember returns a random member of class, preferring
+// printable characters.
+func (g *Generator) classMember(class *characterClass) byte {
+	var printable, all []byte
+	for c := 0; c < 256; c++ {
+		if class.has(uint8(c)) {
+			all = append(all, byte(c))
+			if c == '\t' || c == '\n' || c >= ' ' && c <= '~' {
+				printable = append(printable, byte(c))
+			}
+		}
+	}
+	if len(printable) != 0 {
+		all = printable
+	}
+	if len(all) == 0 {
+		return 0
+	}
+	return all[g.Rand.Intn(len(all))]
+}
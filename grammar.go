@@ -0,0 +1,446 @@
+package peg
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AddPegGrammar adds the rules of the PE grammar for PE grammars,
+// as in cmd/peg/peg.peg, to t. Both must be kept in sync.
+func (t *Tree) AddPegGrammar() (err error) {
+	def := func(name string, e Expr) {
+		if err == nil {
+			err = t.AddDefinition(name, e)
+		}
+	}
+
+	/* Hierarchical syntax */
+	def("Grammar", Seq(Ref("Spacing"), Lit("package"), Ref("Spacing"), Ref("Identifier"), Act(` p.Define("package", yytext) `),
+		Lit("type"), Ref("Spacing"), Ref("Identifier"), Act(` p.Define("Peg", yytext) `),
+		Lit("Peg"), Ref("Spacing"), Ref("Action"), Act(` p.Define("userstate", yytext) `),
+		Commit(),
+		Plus(Alt(Ref("Definition"), Ref("Example"), Ref("Test"), Ref("Keywords"), Ref("Longest"))), Ref("EndOfFile")))
+
+	def("Definition", Seq(Ref("Identifier"), Act(" p.AddRule(yytext) "),
+		Ref("LEFTARROW"), Ref("Expression"), Act(" p.AddExpression() "),
+		And(Alt(Seq(Ref("Identifier"), Ref("LEFTARROW")), Lit("%example"), Lit("%test"), Lit("%keywords"), Lit("%longest"), Not(Dot()))), Commit()))
+
+	def("Example", Seq(Lit("%example"), Ref("Spacing"), Ref("Literal"), Act(" p.AddExample(yytext) "), Commit()))
+
+	def("Test", Seq(Lit("%test"), Ref("Spacing"), Ref("Identifier"), Act(" p.AddTest(yytext) "),
+		Ref("Literal"), Act(" p.SetTestInput(yytext) "),
+		Alt(Seq(Lit("ok"), Ref("Spacing")),
+			Seq(Lit("fail"), Ref("Spacing"), Act(` p.SetTestFail("") `),
+				Query(Seq(Begin(), Plus(Class("0-9")), Lit(":"), Plus(Class("0-9")), End(), Ref("Spacing"),
+					Act(" p.SetTestFail(yytext) "))))),
+		Commit()))
+
+	def("Keywords", Seq(Lit("%keywords"), Ref("Spacing"), Ref("Identifier"), Act(" p.AddKeywords(yytext) "),
+		Ref("Identifier"), Act(" p.SetWordRule(yytext) "),
+		Plus(Seq(Ref("Literal"), Act(" p.AddKeyword(yytext) "))),
+		Commit()))
+
+	def("Longest", Seq(Lit("%longest"), Ref("Spacing"), Ref("Identifier"), Act(" p.SetLongest(yytext) "), Commit()))
+
+	def("Expression", Alt(
+		Seq(Ref("Sequence"),
+			Star(Seq(Ref("SLASH"), Ref("Sequence"), Act(" p.AddAlternate() "))),
+			Query(Seq(Ref("SLASH"), Act(" p.AddNil(); p.AddAlternate() ")))),
+		Act(" p.AddNil() ")))
+
+	def("Sequence", Seq(Ref("Prefix"), Star(Seq(Ref("Prefix"), Act(" p.AddSequence() ")))))
+
+	def("Prefix", Alt(
+		Seq(Ref("AND"), Ref("Action"), Act(" p.AddPredicate(yytext) ")),
+		Seq(Ref("AND"), Ref("Suffix"), Act(" p.AddPeekFor() ")),
+		Seq(Ref("NOT"), Ref("Suffix"), Act(" p.AddPeekNot() ")),
+		Ref("Suffix")))
+
+	def("Suffix", Seq(Ref("Primary"),
+		Query(Alt(
+			Seq(Ref("QUESTION"), Act(" p.AddQuery() ")),
+			Seq(Ref("STAR"), Act(" p.AddStar() ")),
+			Seq(Ref("PLUS"), Act(" p.AddPlus() "))))))
+
+	def("Primary", Alt(
+		Seq(Lit("commit"), Ref("Spacing"), Act(" p.AddCommit() ")),
+		Seq(Ref("CUT"), Act(" p.AddCut() ")),
+		Seq(Ref("Identifier"), Not(Ref("LEFTARROW")), Act(" p.AddName(yytext) ")),
+		Seq(Ref("OPEN"), Ref("Expression"), Ref("CLOSE")),
+		Seq(Ref("Literal"), Act(" p.AddString(yytext) ")),
+		Seq(Ref("Keyword"), Act(" p.AddKeywordLiteral(yytext) ")),
+		Seq(Ref("Class"), Act(" p.AddClass(yytext) ")),
+		Seq(Ref("DOT"), Act(" p.AddDot() ")),
+		Seq(Ref("Action"), Act(" p.AddAction(yytext) ")),
+		Seq(Ref("BEGIN"), Act(" p.AddBegin() ")),
+		Seq(Ref("END"), Act(" p.AddEnd() "))))
+
+	/* Lexical syntax */
+	def("Identifier", Seq(Begin(), Ref("IdentStart"), Star(Ref("IdentCont")), End(), Ref("Spacing")))
+	def("IdentStart", Class("a-zA-Z_"))
+	def("IdentCont", Alt(Ref("IdentStart"), Class("0-9")))
+	def("Literal", Alt(
+		Seq(Class("'"), Begin(), Star(Seq(Not(Class("'")), Ref("Char"))), End(), Class("'"), Ref("Spacing")),
+		Seq(Class(`"`), Begin(), Star(Seq(Not(Class(`"`)), Ref("Char"))), End(), Class(`"`), Ref("Spacing"))))
+	def("Keyword", Seq(Lit("`"), Begin(), Plus(Class("^\\r\\n`")), End(), Lit("`"), Ref("Spacing")))
+	def("Class", Seq(Lit("["), Begin(), Star(Seq(Not(Lit("]")), Ref("Range"))), End(), Lit("]"), Ref("Spacing")))
+	def("Range", Alt(Seq(Ref("Char"), Lit("-"), Ref("Char")), Ref("Char")))
+	def("Char", Alt(
+		Seq(Lit(`\\`), Class(`abefnrtv'"\[\]\\`)),
+		Seq(Lit(`\\`), Class("0-3"), Class("0-7"), Class("0-7")),
+		Seq(Lit(`\\`), Class("0-7"), Query(Class("0-7"))),
+		Seq(Lit(`\\`), Lit("-")),
+		Seq(Not(Lit(`\\`)), Dot())))
+	for _, tok := range []struct{ name, s string }{
+		{"LEFTARROW", "<-"},
+		{"SLASH", "/"},
+		{"AND", "&"},
+		{"NOT", "!"},
+		{"QUESTION", "?"},
+		{"STAR", "*"},
+		{"PLUS", "+"},
+		{"OPEN", "("},
+		{"CLOSE", ")"},
+		{"DOT", "."},
+		{"CUT", "~"},
+	} {
+		def(tok.name, Seq(Lit(tok.s), Ref("Spacing")))
+	}
+	def("Spacing", Star(Alt(Ref("Space"), Ref("Comment"))))
+	def("Comment", Seq(Lit("#"), Star(Seq(Not(Ref("EndOfLine")), Dot())), Ref("EndOfLine")))
+	def("Space", Alt(Lit(" "), Lit(`\t`), Ref("EndOfLine")))
+	def("EndOfLine", Alt(Lit(`\r\n`), Lit(`\n`), Lit(`\r`)))
+	def("EndOfFile", Not(Dot()))
+
+	def("Action", Seq(Lit("{"), Begin(), Star(Class("^}")), End(), Lit("}"), Ref("Spacing")))
+	def("BEGIN", Seq(Lit("<"), Ref("Spacing")))
+	def("END", Seq(Lit(">"), Ref("Spacing")))
+	return
+}
+
+// The PE grammar for LE grammars, from which also the parser
+// of cmd/leg is generated.
+//
+//go:embed leg.peg
+var legGrammar string
+
+// A metaGrammar is a grammar for grammars, whose actions
+// are calls of methods of Tree, like `p.AddRule(yytext)'.
+type metaGrammar struct {
+	prog    *vmProgram
+	actions [][]metaCall
+	names   []string // the names of the rules, by id
+}
+
+type metaCall struct {
+	method string
+	fn     func(t *Tree, args []string) error
+	args   []string // string literals, or yytext
+}
+
+var metaMethods = map[string]func(t *Tree, args []string) error{
+	"AddRule":       func(t *Tree, a []string) error { t.AddRule(a[0]); return nil },
+	"AddRuleType":   func(t *Tree, a []string) error { t.AddRuleType(a[0]); return nil },
+	"AddExpression": func(t *Tree, a []string) error { return t.AddExpression() },
+	"AddAlternate":  func(t *Tree, a []string) error { return t.AddAlternate() },
+	"AddSequence":   func(t *Tree, a []string) error { return t.AddSequence() },
+	"AddPeekFor":    func(t *Tree, a []string) error { return t.AddPeekFor() },
+	"AddPeekNot":    func(t *Tree, a []string) error { return t.AddPeekNot() },
+	"AddQuery":      func(t *Tree, a []string) error { return t.AddQuery() },
+	"AddStar":       func(t *Tree, a []string) error { return t.AddStar() },
+	"AddPlus":       func(t *Tree, a []string) error { return t.AddPlus() },
+	"AddNil":        func(t *Tree, a []string) error { t.AddNil(); return nil },
+	"AddDot":        func(t *Tree, a []string) error { t.AddDot(); return nil },
+	"AddBegin":      func(t *Tree, a []string) error { t.AddBegin(); return nil },
+	"AddEnd":        func(t *Tree, a []string) error { t.AddEnd(); return nil },
+	"AddNamedBegin": func(t *Tree, a []string) error { t.AddNamedBegin(a[0]); return nil },
+	"AddCommit":     func(t *Tree, a []string) error { t.AddCommit(); return nil },
+	"AddCut":        func(t *Tree, a []string) error { t.AddCut(); return nil },
+	"AddName":       func(t *Tree, a []string) error { t.AddName(a[0]); return nil },
+	"AddVariable":   func(t *Tree, a []string) error { t.AddVariable(a[0]); return nil },
+	"AddString":     func(t *Tree, a []string) error { t.AddString(a[0]); return nil },
+	"AddClass":      func(t *Tree, a []string) error { t.AddClass(a[0]); return nil },
+	"AddPredicate":  func(t *Tree, a []string) error { t.AddPredicate(a[0]); return nil },
+	"AddAction":     func(t *Tree, a []string) error { t.AddAction(a[0]); return nil },
+	"AddHeader":     func(t *Tree, a []string) error { t.AddHeader(a[0]); return nil },
+	"AddTrailer":    func(t *Tree, a []string) error { t.AddTrailer(a[0]); return nil },
+	"AddExample":    func(t *Tree, a []string) error { t.AddExample(a[0]); return nil },
+	"AddTest":       func(t *Tree, a []string) error { t.AddTest(a[0]); return nil },
+	"SetTestInput":  func(t *Tree, a []string) error { t.SetTestInput(a[0]); return nil },
+	"SetTestFail":   func(t *Tree, a []string) error { return t.SetTestFail(a[0]) },
+	"AddKeywords":   func(t *Tree, a []string) error { t.AddKeywords(a[0]); return nil },
+	"SetWordRule":   func(t *Tree, a []string) error { return t.SetWordRule(a[0]) },
+	"AddKeyword":    func(t *Tree, a []string) error { return t.AddKeyword(a[0]) },
+	"SetLongest":    func(t *Tree, a []string) error { t.SetLongest(a[0]); return nil },
+	"Define":        func(t *Tree, a []string) error { t.Define(a[0], a[1]); return nil },
+	"SwitchExclude": func(t *Tree, a []string) error { t.SwitchExclude(a[0]); return nil },
+
+	"AddKeywordLiteral": func(t *Tree, a []string) error { t.AddKeywordLiteral(a[0]); return nil },
+}
+
+// parseMetaCalls splits the code of an action into calls of the
+// form p.Method(arg, ...), separated by semicolons.
+func parseMetaCalls(code string) (calls []metaCall, err error) {
+	for _, stmt := range strings.Split(code, ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt == "" {
+			continue
+		}
+		open := strings.IndexByte(stmt, '(')
+		if !strings.HasPrefix(stmt, "p.") || open == -1 || !strings.HasSuffix(stmt, ")") {
+			return nil, fmt.Errorf("peg: unsupported action: %s", stmt)
+		}
+		c := metaCall{method: stmt[2:open]}
+		if c.fn = metaMethods[c.method]; c.fn == nil {
+			return nil, fmt.Errorf("peg: unknown method in action: %s", stmt)
+		}
+		if args := strings.TrimSpace(stmt[open+1 : len(stmt)-1]); args != "" {
+			for _, a := range strings.Split(args, ",") {
+				if a = strings.TrimSpace(a); a != "yytext" {
+					if a, err = strconv.Unquote(a); err != nil {
+						return nil, fmt.Errorf("peg: bad argument in action: %s", stmt)
+					}
+				}
+				c.args = append(c.args, a)
+			}
+		}
+		calls = append(calls, c)
+	}
+	return
+}
+
+func newMetaGrammar(t *Tree) (*metaGrammar, error) {
+	var warnings []string
+	t.warnings = &warnings
+	t.resolve()
+	m := &metaGrammar{prog: t.compileProgram(false)}
+	for _, r := range t.Rules() {
+		m.names = append(m.names, r.String())
+	}
+	for _, a := range t.Actions {
+		calls, err := parseMetaCalls(a.text)
+		if err != nil {
+			return nil, err
+		}
+		m.actions = append(m.actions, calls)
+	}
+	return m, nil
+}
+
+// metaParser is the Host for a metaGrammar, building a Tree.
+type metaParser struct {
+	*metaGrammar
+	t      *Tree
+	err    error
+	offset int // the offset of yytext
+}
+
+func (p *metaParser) Do(action int, yytext string, offset int) {
+	if p.err != nil {
+		return
+	}
+	p.offset = offset
+	for _, c := range p.actions[action] {
+		args := make([]string, len(c.args))
+		for i, a := range c.args {
+			if a == "yytext" {
+				a = yytext
+			}
+			args[i] = a
+		}
+		if p.err = c.fn(p.t, args); p.err != nil {
+			return
+		}
+	}
+}
+
+func (p *metaParser) Predicate(int) bool { return true }
+
+// parse parses the source of a grammar into a new Tree.
+// The farthest position reached is returned in case of an error.
+func (m *metaGrammar) parse(src string) (t *Tree, max int, err error) {
+	t = New(false, false)
+	p := &metaParser{metaGrammar: m, t: t}
+	t.SetOffsetFunc(func() int { return p.offset })
+	defer t.SetOffsetFunc(nil)
+	var vm Machine
+	ok := vm.Run(&m.prog.Program, 0, src, p)
+	switch {
+	case p.err != nil:
+		err = p.err
+	case !ok:
+		err = newParseError(src, vm.Max, ruleNames(m.names, vm.Trace(&m.prog.Program, 0, src, p)))
+	}
+	return t, vm.Max, err
+}
+
+var meta struct {
+	once     sync.Once
+	peg, leg *metaGrammar
+	err      error
+}
+
+func loadMetaGrammars() {
+	t := New(false, false)
+	if meta.err = t.AddPegGrammar(); meta.err != nil {
+		return
+	}
+	if meta.peg, meta.err = newMetaGrammar(t); meta.err != nil {
+		return
+	}
+	t, _, meta.err = meta.peg.parse(legGrammar)
+	if meta.err != nil {
+		return
+	}
+	meta.leg, meta.err = newMetaGrammar(t)
+}
+
+/*
+A Grammar is a grammar loaded at runtime using Load. It is executed
+by the parsing machine, without generating Go code. Actions
+are ignored, and `commit' has no effect. A Grammar may be used
+by multiple goroutines simultaneously.
+*/
+type Grammar struct {
+	Tree     *Tree
+	Warnings []string // e.g. about unused rules
+	prog     *vmProgram
+	ruleIds  map[string]int
+	names    []string
+}
+
+/*
+Load parses the source of a PE or LE grammar, as accepted by
+cmd/peg, and cmd/leg. If the source is neither a valid PE
+grammar nor a valid LE grammar, the error of the dialect that
+got farther is returned. Grammars containing semantic predicates,
+references to undefined rules, or left recursion are rejected.
+*/
+func Load(src string) (*Grammar, error) {
+	t, err := LoadTree(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.checkKeywords(); err != nil {
+		return nil, err
+	}
+	g := &Grammar{Tree: t, ruleIds: make(map[string]int)}
+	t.warnings = &g.Warnings
+	t.resolve()
+
+	for _, r := range t.Rules() {
+		if r.GetExpression() == nilNode {
+			return nil, fmt.Errorf("peg: rule '%v' used but not defined", r)
+		}
+		var pred Node
+		Walk(r.GetExpression(), func(n Node) {
+			if n.GetType() == TypePredicate && pred == nil {
+				pred = n
+			}
+		})
+		if pred != nil {
+			return nil, fmt.Errorf("peg: rule '%v': semantic predicates are not supported", r)
+		}
+		g.ruleIds[r.String()] = r.GetId()
+		g.names = append(g.names, r.String())
+	}
+	if len(t.leftRecursive) != 0 {
+		return nil, fmt.Errorf("peg: possible infinite left recursion in rule '%s'", t.leftRecursive[0])
+	}
+	g.prog = t.compileProgram(true)
+	return g, nil
+}
+
+// LoadTree parses the source of a PE or LE grammar into a Tree,
+// like Load, but without checking the grammar, see Check. The offsets
+// of rules and expressions within src are recorded, see Offset. If
+// the source contains a syntax error, a *ParseError is returned
+// together with a Tree containing the definitions before the error.
+func LoadTree(src string) (*Tree, error) {
+	meta.once.Do(loadMetaGrammars)
+	if meta.err != nil {
+		return nil, meta.err
+	}
+	t, max, err := meta.peg.parse(src)
+	if err != nil {
+		t2, max2, err2 := meta.leg.parse(src)
+		if err2 == nil || max2 > max {
+			t, err = t2, err2
+		}
+	}
+	if _, ok := err.(*ParseError); err != nil && !ok {
+		t = nil
+	}
+	return t, err
+}
+
+// A ParseTree represents the match of a rule.
+type ParseTree struct {
+	Rule       string
+	Begin, End int // offsets into the input
+	Text       string
+	Children   []*ParseTree
+}
+
+// treeBuilder is the Host for a Grammar's program.
+type treeBuilder struct {
+	g     *Grammar
+	input string
+	stack []*ParseTree
+	root  *ParseTree
+}
+
+func (b *treeBuilder) Do(action int, _ string, pos int) {
+	if action%2 == 0 {
+		n := &ParseTree{Rule: b.g.names[action/2], Begin: pos}
+		if len(b.stack) == 0 {
+			b.root = n
+		} else {
+			parent := b.stack[len(b.stack)-1]
+			parent.Children = append(parent.Children, n)
+		}
+		b.stack = append(b.stack, n)
+		return
+	}
+	n := b.stack[len(b.stack)-1]
+	b.stack = b.stack[:len(b.stack)-1]
+	n.End = pos
+	n.Text = b.input[n.Begin:pos]
+}
+
+func (b *treeBuilder) Predicate(int) bool { return true }
+
+// Parse applies rule to input, and returns the parse tree.
+// Like the Parse method of generated parsers, it does not
+// require the input to be consumed completely. If the rule
+// does not match, a *ParseError is returned.
+func (g *Grammar) Parse(input, rule string) (*ParseTree, error) {
+	return g.ParseTrace(input, rule, nil)
+}
+
+// ruleNames returns the names of the rules with the given ids.
+func ruleNames(names []string, ids []int) (s []string) {
+	for _, id := range ids {
+		s = append(s, names[id])
+	}
+	return
+}
+
+// ParseTrace is like Parse, but notifies tracer, if not nil, of
+// each rule call. Rules are identified by their ids, see RuleId.
+func (g *Grammar) ParseTrace(input, rule string, tracer Tracer) (*ParseTree, error) {
+	id, ok := g.ruleIds[rule]
+	if !ok {
+		return nil, errors.New("peg: no such rule: " + rule)
+	}
+	vm := Machine{Tracer: tracer}
+	b := &treeBuilder{g: g, input: input}
+	if !vm.Run(&g.prog.Program, id, input, b) {
+		return nil, newParseError(input, vm.Max, ruleNames(g.names, vm.Trace(&g.prog.Program, id, input, b)))
+	}
+	return b.root, nil
+}
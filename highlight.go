@@ -0,0 +1,445 @@
+package peg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+)
+
+// HighlightFormats lists the formats supported by Highlighting.
+var HighlightFormats = []string{"textmate", "tree-sitter"}
+
+/*
+Highlighting returns the files defining the syntax highlighting of
+grammars for editors, by file name. The dialect is "peg" or "leg".
+Format "textmate" results in a TextMate grammar, as used e.g. by
+VS Code and Sublime Text; format "tree-sitter" results in a
+tree-sitter grammar, to be compiled using `tree-sitter generate',
+together with queries for highlights and injections. Go code in
+actions, and in the header and the trailer of LE grammars, is marked
+as embedded Go: it is given to the grammar of scope source.go, or the
+tree-sitter language go.
+*/
+func Highlighting(format, dialect string) (map[string][]byte, error) {
+	var d *highlightDialect
+	switch dialect {
+	case "peg":
+		d = &highlightDialect{Name: dialect, Ident: `[a-zA-Z_][a-zA-Z_0-9]*`, Define: "<-", Alternate: "/"}
+	case "leg":
+		d = &highlightDialect{Name: dialect, LEG: true, Ident: `[-a-zA-Z_][-a-zA-Z_0-9]*`, Define: "=", Alternate: "|"}
+	default:
+		return nil, fmt.Errorf("peg: unknown dialect %q", dialect)
+	}
+	files := make(map[string][]byte)
+	switch format {
+	case "textmate":
+		b, err := d.textMate()
+		if err != nil {
+			return nil, err
+		}
+		files[dialect+".tmLanguage.json"] = b
+	case "tree-sitter":
+		dir := "tree-sitter-" + dialect + "/"
+		for name, text := range map[string]string{
+			"grammar.js":             treeSitterGrammar,
+			"queries/highlights.scm": treeSitterHighlights,
+			"queries/injections.scm": treeSitterInjections,
+		} {
+			var b bytes.Buffer
+			if err := template.Must(template.New(name).Parse(text)).Execute(&b, d); err != nil {
+				return nil, err
+			}
+			files[dir+name] = b.Bytes()
+		}
+	default:
+		return nil, fmt.Errorf("peg: unknown highlighting format %q", format)
+	}
+	return files, nil
+}
+
+// A highlightDialect describes the lexical differences
+// between PE and LE grammars.
+type highlightDialect struct {
+	Name      string // the name of the language, "peg" or "leg"
+	LEG       bool
+	Ident     string // a regular expression matching identifiers
+	Define    string // the token separating a rule's name from its expression
+	Alternate string // the token separating alternatives
+}
+
+// A tmRule is a rule of a TextMate grammar.
+type tmRule struct {
+	Name          string     `json:"name,omitempty"`
+	ContentName   string     `json:"contentName,omitempty"`
+	Include       string     `json:"include,omitempty"`
+	Match         string     `json:"match,omitempty"`
+	Begin         string     `json:"begin,omitempty"`
+	End           string     `json:"end,omitempty"`
+	Captures      tmCaptures `json:"captures,omitempty"`
+	BeginCaptures tmCaptures `json:"beginCaptures,omitempty"`
+	EndCaptures   tmCaptures `json:"endCaptures,omitempty"`
+	Patterns      []tmRule   `json:"patterns,omitempty"`
+}
+
+type tmCaptures map[string]struct {
+	Name string `json:"name"`
+}
+
+func (d *highlightDialect) textMate() ([]byte, error) {
+	// scope appends the name of the language to scope names
+	scope := func(name string) string {
+		return name + "." + d.Name
+	}
+	// captures assigns scope names to the groups of a regular
+	// expression, in order; empty names are skipped.
+	captures := func(names ...string) tmCaptures {
+		c := make(tmCaptures)
+		for i, name := range names {
+			if name != "" {
+				c[fmt.Sprint(i+1)] = struct {
+					Name string `json:"name"`
+				}{scope(name)}
+			}
+		}
+		return c
+	}
+	include := func(names ...string) (rules []tmRule) {
+		for _, name := range names {
+			rules = append(rules, tmRule{Include: "#" + name})
+		}
+		return
+	}
+	embeddedGo := func(begin, end string, patterns ...tmRule) tmRule {
+		return tmRule{
+			Begin:         begin,
+			End:           end,
+			BeginCaptures: captures("punctuation.section.embedded.begin"),
+			EndCaptures:   captures("punctuation.section.embedded.end"),
+			ContentName:   "meta.embedded.block.go",
+			Patterns:      append(patterns, tmRule{Include: "source.go"}),
+		}
+	}
+	goType := `((?:\*|\[\])*[a-zA-Z_][a-zA-Z_0-9.]*)`
+
+	r := map[string]tmRule{
+		"comment": {Name: scope("comment.line.number-sign"), Match: `#.*$`},
+		"escape":  {Name: scope("constant.character.escape"), Match: `\\(?:[0-7]{1,3}|.)`},
+		"string-single": {
+			Name:     scope("string.quoted.single"),
+			Begin:    `'`,
+			End:      `'`,
+			Patterns: include("escape"),
+		},
+		"string-double": {
+			Name:     scope("string.quoted.double"),
+			Begin:    `"`,
+			End:      `"`,
+			Patterns: include("escape"),
+		},
+		"keyword-literal": {Name: scope("string.quoted.other.keyword"), Match: "`[^`\\r\\n]+`"},
+		"class": {
+			Name:     scope("constant.other.character-class.set"),
+			Begin:    `\[`,
+			End:      `\]`,
+			Patterns: include("escape"),
+		},
+		"action": embeddedGo(`\{`, `\}`, include("braces")...),
+		"braces": {
+			Begin:    `\{`,
+			End:      `\}`,
+			Patterns: append(include("braces"), tmRule{Include: "source.go"}),
+		},
+		"test": {
+			Begin:         `(%test)\s+(` + d.Ident + `)`,
+			End:           `\b(ok)\b|\b(fail)\b(?:\s+([0-9]+:[0-9]+))?`,
+			BeginCaptures: captures("keyword.other.directive", "entity.name.function"),
+			EndCaptures:   captures("constant.language", "constant.language", "constant.numeric"),
+			Patterns:      include("comment", "string-single", "string-double"),
+		},
+		"keywords": {
+			Match:    `(%keywords)\s+(` + d.Ident + `)\s+(` + d.Ident + `)`,
+			Captures: captures("keyword.other.directive", "entity.name.function", "variable.other.rule"),
+		},
+		"longest": {
+			Match:    `(%longest)\s+(` + d.Ident + `)`,
+			Captures: captures("keyword.other.directive", "variable.other.rule"),
+		},
+		"example": {Name: scope("keyword.other.directive"), Match: `%example\b`},
+		"definition": {
+			Match:    `(` + d.Ident + `)\s*(<-)`,
+			Captures: captures("entity.name.function", "keyword.operator.definition"),
+		},
+		"commit":      {Name: scope("keyword.control"), Match: `\bcommit\b`},
+		"cut":         {Name: scope("keyword.control.cut"), Match: `~`},
+		"reference":   {Name: scope("variable.other.rule"), Match: d.Ident},
+		"dot":         {Name: scope("constant.character.any"), Match: `\.`},
+		"alternation": {Name: scope("keyword.operator.alternation"), Match: `/`},
+		"predicate":   {Name: scope("keyword.operator.predicate"), Match: `[&!]`},
+		"quantifier":  {Name: scope("keyword.operator.quantifier"), Match: `[?*+]`},
+		"capture":     {Name: scope("keyword.operator.capture"), Match: `[<>]`},
+		"parenthesis": {Name: scope("punctuation.parenthesis"), Match: `[()]`},
+	}
+	var top []tmRule
+	if d.LEG {
+		r["header"] = embeddedGo(`%\{`, `%\}`)
+		r["trailer"] = embeddedGo(`^%%`, `(?!)`) // never ends
+		r["directive"] = tmRule{
+			Match:    `(%(?:YYSTYPE|userstate))\s+` + goType,
+			Captures: captures("keyword.other.directive", "entity.name.type"),
+		}
+		r["directive-simple"] = tmRule{Name: scope("keyword.other.directive"), Match: `%(?:noexport|switchexcl)\b`}
+		r["definition"] = tmRule{
+			Match:    `(` + d.Ident + `)\s*(?:(:)\s*` + goType + `\s*)?(=)`,
+			Captures: captures("entity.name.function", "punctuation.separator", "entity.name.type", "keyword.operator.definition"),
+		}
+		r["named-begin"] = tmRule{
+			Match:    `(<@)(` + d.Ident + `)\s*(:)`,
+			Captures: captures("keyword.operator.capture", "variable.parameter", "punctuation.separator"),
+		}
+		r["variable"] = tmRule{
+			Match:    `(` + d.Ident + `)\s*(:)`,
+			Captures: captures("variable.parameter", "punctuation.separator"),
+		}
+		r["alternation"] = tmRule{Name: scope("keyword.operator.alternation"), Match: `\|`}
+		r["terminator"] = tmRule{Name: scope("punctuation.terminator"), Match: `;`}
+		top = include("comment", "header", "trailer", "directive", "directive-simple", "example", "test", "keywords", "longest", "action",
+			"definition", "named-begin", "variable", "commit")
+	} else {
+		r["package"] = tmRule{
+			Match:    `^\s*(package)\s+(` + d.Ident + `)`,
+			Captures: captures("keyword.other.package", "entity.name.package"),
+		}
+		r["type"] = tmRule{
+			Match:    `\b(type)\s+(` + d.Ident + `)\s+(Peg)\b`,
+			Captures: captures("keyword.other.type", "entity.name.type", "keyword.other.type"),
+		}
+		top = include("comment", "package", "type", "example", "test", "keywords", "longest", "action", "definition", "commit")
+	}
+	top = append(top, include("cut", "string-single", "string-double", "keyword-literal", "class", "reference", "dot",
+		"alternation", "predicate", "quantifier", "capture", "parenthesis")...)
+	if d.LEG {
+		top = append(top, include("terminator")...)
+	}
+
+	g := struct {
+		Name       string            `json:"name"`
+		ScopeName  string            `json:"scopeName"`
+		FileTypes  []string          `json:"fileTypes"`
+		Patterns   []tmRule          `json:"patterns"`
+		Repository map[string]tmRule `json:"repository"`
+	}{
+		Name:       d.Name,
+		ScopeName:  "source." + d.Name,
+		FileTypes:  []string{d.Name},
+		Patterns:   top,
+		Repository: r,
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(g); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// The tree-sitter grammar does not build a tree of the rules
+// of a grammar; it recognizes the tokens needed for highlighting,
+// and the Go code in actions, headers, and trailers, which is
+// injected as Go by the injection query. Like the grammar of LEG,
+// it lets braces within actions nest, using code_block.
+const treeSitterGrammar = `// Tree-sitter grammar of the {{.Name}} dialect of github.com/knieriem/peg,
+// made for syntax highlighting; the elements of a grammar are not
+// arranged into a tree of rules and expressions.
+module.exports = grammar({
+  name: '{{.Name}}',
+
+  word: $ => $.identifier,
+
+  extras: $ => [/\s/, $.comment],
+
+  rules: {
+    source_file: $ => seq(
+{{- if .LEG}}
+      repeat($._item),
+      optional($.trailer),
+{{- else}}
+      optional($.header),
+      repeat($._item),
+{{- end}}
+    ),
+
+    _item: $ => choice(
+      $.definition,
+      $.reference,
+{{- if .LEG}}
+      $.variable,
+      $.named_begin,
+      $.header,
+      $.directive,
+{{- end}}
+      $.example,
+      $.test,
+      $.keywords,
+      $.longest,
+      $.commit,
+      '~',
+      $.string,
+      $.keyword_literal,
+      $.class,
+      $.action,
+      '{{.Alternate}}', '&', '!', '?', '*', '+', '(', ')', '.', '<', '>',{{if .LEG}} ';',{{end}}
+    ),
+{{if .LEG}}
+    header: $ => seq('%{', optional(alias($._header_code, $.code)), '%}'),
+
+    _header_code: $ => token.immediate(/([^%]|%[^}])+/),
+
+    trailer: $ => seq('%%', optional(alias($._trailer_code, $.code))),
+
+    _trailer_code: $ => token.immediate(/[\s\S]+/),
+
+    directive: $ => choice(
+      seq(choice('%YYSTYPE', '%userstate'), $.type),
+      '%noexport',
+      seq('%switchexcl', '(', repeat1($.identifier), ')'),
+    ),
+
+    definition: $ => seq(
+      field('name', $.identifier),
+      optional(seq(':', field('type', $.type))),
+      '=',
+    ),
+
+    variable: $ => seq(
+      field('name', $.identifier),
+      ':',
+      field('rule', alias($.type, $.identifier)),
+    ),
+
+    named_begin: $ => /<@[-a-zA-Z_][-a-zA-Z_0-9]*\s*:/,
+
+    type: $ => /(\*|\[\])*[-a-zA-Z_][-a-zA-Z_0-9.]*/,
+{{else}}
+    header: $ => seq(
+      'package', field('package', $.identifier),
+      'type', field('type', $.identifier), 'Peg',
+      $.action,
+    ),
+
+    definition: $ => seq(field('name', $.identifier), '<-'),
+{{end}}
+    reference: $ => $.identifier,
+
+    example: $ => seq('%example', $.string),
+
+    test: $ => seq(
+      '%test',
+      field('rule', $.identifier),
+      $.string,
+      choice('ok', seq('fail', optional($.position))),
+    ),
+
+    position: $ => /[0-9]+:[0-9]+/,
+
+    keywords: $ => prec.right(seq(
+      '%keywords',
+      field('rule', $.identifier),
+      field('word', $.identifier),
+      repeat1($.string),
+    )),
+
+    longest: $ => seq('%longest', field('rule', $.identifier)),
+
+    commit: $ => 'commit',
+
+    string: $ => choice(
+      /'([^'\\]|\\[\s\S])*'/,
+      /"([^"\\]|\\[\s\S])*"/,
+    ),
+
+    keyword_literal: $ => /` + "`" + `[^` + "`" + `\r\n]+` + "`" + `/,
+
+    class: $ => /\[([^\]\\]|\\[\s\S])*\]/,
+
+    action: $ => seq('{', optional($.code), '}'),
+{{if .LEG}}
+    code: $ => repeat1(choice($._code_text, $.code_block)),
+
+    code_block: $ => seq('{', repeat(choice($._code_text, $.code_block)), '}'),
+
+    _code_text: $ => token.immediate(/[^{}]+/),
+{{else}}
+    code: $ => token.immediate(/[^}]+/),
+{{end}}
+    identifier: $ => /{{.Ident}}/,
+
+    comment: $ => /#.*/,
+  },
+});
+`
+
+const treeSitterHighlights = `(comment) @comment
+
+(definition name: (identifier) @function)
+{{- if .LEG}}
+(definition type: (type) @type)
+(variable name: (identifier) @variable.parameter)
+(variable rule: (identifier) @function.call)
+(named_begin) @variable.parameter
+(directive (type) @type)
+(directive (identifier) @function.call)
+{{- else}}
+(header package: (identifier) @module)
+(header type: (identifier) @type)
+{{- end}}
+(reference) @function.call
+(test rule: (identifier) @function.call)
+(keywords rule: (identifier) @function)
+(keywords word: (identifier) @function.call)
+(longest rule: (identifier) @function.call)
+
+[
+{{- if .LEG}}
+  "%YYSTYPE"
+  "%userstate"
+  "%noexport"
+  "%switchexcl"
+{{- else}}
+  "package"
+  "type"
+  "Peg"
+{{- end}}
+  "%example"
+  "%test"
+  "%keywords"
+  "%longest"
+] @keyword.directive
+
+(commit) @keyword
+"~" @keyword
+
+["ok" "fail"] @constant.builtin
+(position) @number
+
+(string) @string
+(keyword_literal) @string.special
+(class) @string.regexp
+"." @character.special
+
+["{{.Define}}" "{{.Alternate}}" "&" "!" "?" "*" "+"] @operator
+["<" ">"] @punctuation.special
+["(" ")"] @punctuation.bracket
+{{- if .LEG}}
+[":" ";"] @punctuation.delimiter
+["%{" "%}" "%%"] @punctuation.special
+{{- end}}
+["{" "}"] @punctuation.special
+`
+
+const treeSitterInjections = `((code) @injection.content
+ (#set! injection.language "go")
+ (#set! injection.include-children))
+`
@@ -0,0 +1,178 @@
+package peg
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A keywordSet is declared by a directive like
+// `%keywords Ident Word 'if' 'else'`.
+type keywordSet struct {
+	id       int    // the index of the set within the tree
+	ident    string // the rule matching words that are not keywords
+	word     string // the rule matching words
+	keywords []string
+}
+
+func (s *keywordSet) has(kw string) bool {
+	for _, k := range s.keywords {
+		if k == kw {
+			return true
+		}
+	}
+	return false
+}
+
+// sorted returns the keywords of the set in lexical order.
+func (s *keywordSet) sorted() []string {
+	list := append([]string(nil), s.keywords...)
+	sort.Strings(list)
+	return list
+}
+
+/* Used to represent TypeKeyword and TypeIdent. */
+type keyword struct {
+	Type
+	string string // the keyword; for TypeIdent, the name of the word rule
+	set    *keywordSet
+}
+
+func (k *keyword) String() string {
+	if k.Type == TypeIdent {
+		return k.set.word
+	}
+	return k.string
+}
+
+// AddKeywords declares a set of keywords, and adds a rule named
+// ident, which matches what the rule set by SetWordRule matches,
+// unless the text matched is a keyword added by AddKeyword.
+// A keyword literal added by AddKeywordLiteral, like `if`, within
+// any rule other than the word rule, matches only if the word rule
+// matches the keyword exactly; thus keyword `if` does not match
+// the beginning of `iffy'.
+func (t *Tree) AddKeywords(ident string) {
+	t.keywords = append(t.keywords, &keywordSet{id: len(t.keywords), ident: ident})
+	t.AddRule(ident)
+}
+
+// SetWordRule sets the rule matching a single word, like
+// `[a-zA-Z_][a-zA-Z_0-9]*', for the set declared by AddKeywords,
+// and completes the identifier rule.
+func (t *Tree) SetWordRule(word string) error {
+	set := t.keywords[len(t.keywords)-1]
+	set.word = word
+	if t.rules[word] == nil {
+		t.rules[word] = &rule{}
+	}
+	n := &keyword{Type: TypeIdent, set: set}
+	t.setOffset(n, 0)
+	t.push(n)
+	return t.AddExpression()
+}
+
+// AddKeyword adds a keyword, given as the contents of a string
+// literal, to the set declared by AddKeywords.
+func (t *Tree) AddKeyword(text string) (err error) {
+	set := t.keywords[len(t.keywords)-1]
+	switch kw := unescape(text); {
+	case kw == "":
+		err = fmt.Errorf("peg: AddKeyword: empty keyword for rule '%s'", set.ident)
+		if t.err == nil {
+			t.err = err
+		}
+	case !set.has(kw):
+		set.keywords = append(set.keywords, kw)
+	}
+	return
+}
+
+// AddKeywordLiteral adds a keyword literal, like `if` within a
+// grammar, which matches kw only if the word rule of the set
+// declaring kw matches kw exactly, see AddKeywords. The set may
+// be declared after the literal has been added.
+func (t *Tree) AddKeywordLiteral(kw string) {
+	n := &keyword{Type: TypeKeyword, string: kw}
+	t.setOffset(n, 1)
+	t.push(n)
+}
+
+// keywordSet returns the set declaring kw, or nil.
+func (t *Tree) keywordSet(kw string) *keywordSet {
+	for _, set := range t.keywords {
+		if set.has(kw) {
+			return set
+		}
+	}
+	return nil
+}
+
+// undeclaredKeywords returns the keyword literals of the rules
+// whose keywords have not been declared by a set.
+func (t *Tree) undeclaredKeywords() (literals []*keyword) {
+	for _, r := range t.Rules() {
+		Walk(r.GetExpression(), func(node Node) {
+			if k, ok := node.(*keyword); ok && k.set == nil && t.keywordSet(k.string) == nil {
+				literals = append(literals, k)
+			}
+		})
+	}
+	return
+}
+
+// checkKeywords returns an error if the keyword
+// of a keyword literal has not been declared.
+func (t *Tree) checkKeywords() error {
+	if k := t.undeclaredKeywords(); k != nil {
+		return fmt.Errorf("peg: keyword '%s' not declared using %%keywords", k[0].string)
+	}
+	return nil
+}
+
+// hasKeywords returns whether keywords have been declared.
+func (t *Tree) hasKeywords() bool { return len(t.keywords) != 0 }
+
+// resolveKeywords assigns their sets to keyword literals. Within
+// the word rules, and if a keyword has not been declared, a keyword
+// literal is replaced by a string literal; the latter case is
+// reported as a warning.
+func (t *Tree) resolveKeywords() {
+	words := make(map[string]bool)
+	for _, set := range t.keywords {
+		words[set.word] = true
+	}
+	replace := func(node Node, word bool) Node {
+		k, ok := node.(*keyword)
+		if !ok || k.set != nil {
+			return node
+		}
+		if !word {
+			if k.set = t.keywordSet(k.string); k.set != nil {
+				return k
+			}
+			t.warnf("keyword '%s' not declared using %%keywords, matched as a string", k.string)
+		}
+		t.AddString(escape(k.string))
+		n := t.pop()
+		if offset, ok := t.offsets[node]; ok {
+			t.offsets[n] = offset
+		}
+		return n
+	}
+	for _, r := range t.Rules() {
+		if r.GetExpression() == nilNode {
+			continue
+		}
+		word := words[r.String()]
+		r.(*rule).expression = replace(r.GetExpression(), word)
+		Walk(r.GetExpression(), func(node Node) {
+			switch node.GetType() {
+			case TypeAlternate, TypeUnorderedAlternate, TypeSequence,
+				TypePeekFor, TypePeekNot, TypeQuery, TypeStar, TypePlus:
+				for el := node.(List).front(); el != nil; el = el.Next() {
+					el.Value = replace(el.Value.(Node), word)
+				}
+			}
+		})
+	}
+}
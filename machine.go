@@ -0,0 +1,396 @@
+package peg
+
+import "sort"
+
+/*
+A parsing machine in the style of LPeg's, that executes a Program
+as created by Tree.CompileVM. Each instruction consists of an opcode,
+stored in the lower eight bits, and an argument, stored in the upper
+bits, like in
+
+	OpChar | 'a'<<8
+
+The machine keeps a stack of entries, which are either call frames,
+backtrack entries pushed by OpChoice, or cut entries pushed by OpCut.
+If a match fails, entries are popped until a backtrack entry is found;
+the reading position and the thunk position are restored, and execution
+continues at the address saved within the entry. If a cut entry is
+found first, the run fails without further backtracking.
+
+Actions are not executed immediately. Like in generated Go code,
+they are recorded as thunks, which are executed by OpThunks (the
+`commit' operator), or when the start rule has matched.
+*/
+type Inst uint32
+
+const (
+	OpFail          Inst = iota // fail
+	OpAny                       // match any byte
+	OpChar                      // match byte arg
+	OpSet                       // match a byte of Classes[arg]
+	OpString                    // match Strings[arg]
+	OpCall                      // call the rule at address arg
+	OpReturn                    // return from a rule
+	OpJump                      // jump to address arg
+	OpChoice                    // push a backtrack entry for address arg
+	OpCommit                    // pop a backtrack entry, jump to arg
+	OpPartialCommit             // update the top backtrack entry, jump to arg
+	OpBackCommit                // pop a backtrack entry and restore positions, jump to arg
+	OpFailTwice                 // pop a backtrack entry, fail
+	OpBegin                     // set the beginning of yytext
+	OpEnd                       // set the end of yytext
+	OpDo                        // record a thunk for action arg
+	OpDoArg                     // like OpDo, the thunk's argument is the following word
+	OpPredicate                 // call predicate arg, fail if it returns false
+	OpThunks                    // execute thunks, if there are no others pending outside the rule
+	OpPosition                  // record a thunk for action arg, with yytext empty at the current position
+	OpCut                       // push a cut entry, and reset Max to the current position
+	OpCutEnd                    // pop a cut entry, restoring Max if it was farther
+	OpKeyword                   // check that the text since the top backtrack entry is Strings[arg]
+	OpIdent                     // check that the text since the top backtrack entry is not in Keywords[arg]
+)
+
+func (i Inst) Op() Inst { return i & 0xff }
+func (i Inst) Arg() int { return int(int32(i) >> 8) }
+
+// A Program is a grammar compiled into instructions
+// for a Machine.
+type Program struct {
+	Code     []Inst
+	Rules    []int // the address of each rule, -1 if undefined
+	Strings  []string
+	Classes  [][32]uint8
+	Keywords [][]string // the sets of keywords, sorted
+}
+
+// isKeyword returns whether s is in the set of keywords k.
+func (p *Program) isKeyword(k int, s string) bool {
+	set := p.Keywords[k]
+	i := sort.SearchStrings(set, s)
+	return i < len(set) && set[i] == s
+}
+
+// A Host executes the actions and semantic predicates
+// a Program refers to by index.
+type Host interface {
+	Do(action int, yytext string, arg int)
+	Predicate(id int) bool
+}
+
+type machineThunk struct {
+	action     int
+	begin, end int
+}
+
+type machineEntry struct {
+	addr     int // return or backtrack address; Max at the cut for cut entries
+	position int // -1 for call frames, -2 for cut entries
+	thunkPos int
+}
+
+// A Tracer is notified of the rule calls made by a Machine.
+type Tracer interface {
+	Enter(rule, position int)
+	Leave(rule, position int, match bool) // position is the end of the match, or of the failure
+}
+
+/*
+A Machine runs Programs. It contains the state of a parse; its
+zero value is ready to use. Position is the current reading position,
+Min the position of the last commit, and Max the farthest position
+at which a terminal did not match; if a run failed after a cut, Max
+is the farthest such position after the cut. If Budget is positive, it is the
+number of steps, i.e. instructions, left to execute; after the last of them
+Budget is -1, and Run panics instead of executing another step. If Tracer
+is set, it is notified of each rule call.
+*/
+type Machine struct {
+	Position, Min, Max int
+	Budget             int
+	Tracer             Tracer
+	begin, end         int
+	thunks             []machineThunk
+	thunkPos           int
+	stack              []machineEntry
+	trace              *machineTrace // set by Trace
+}
+
+// machineTrace records the call frames at the farthest failure.
+type machineTrace struct {
+	max   int // the farthest failure of the first attempt
+	calls []int
+	done  bool
+}
+
+// Reset prepares m for parsing a new buffer.
+func (m *Machine) Reset() {
+	m.Position = 0
+	m.Min = 0
+	m.Max = 0
+	m.end = 0
+	m.thunkPos = 0
+}
+
+func (m *Machine) doarg(action, arg int) {
+	if m.thunkPos == len(m.thunks) {
+		m.thunks = append(m.thunks, machineThunk{})
+	}
+	t := &m.thunks[m.thunkPos]
+	m.thunkPos++
+	t.action = action
+	if arg != 0 {
+		t.begin = arg // use begin to store an argument
+	} else {
+		t.begin = m.begin
+	}
+	t.end = m.end
+}
+
+func (m *Machine) commit(buffer string, host Host) {
+	s := ""
+	thunks := m.thunks[:m.thunkPos]
+	if m.trace != nil {
+		thunks = nil // actions are not executed while tracing
+	}
+	for _, t := range thunks {
+		b := t.begin
+		if b >= 0 && b <= t.end {
+			s = buffer[b:t.end]
+		}
+		host.Do(t.action, s, b)
+	}
+	m.Min = m.Position
+	m.thunkPos = 0
+}
+
+// Run applies rule to buffer, starting at m.Position. If the rule
+// matches, pending thunks are executed and true is returned.
+func (m *Machine) Run(prog *Program, rule int, buffer string, host Host) bool {
+	pc := prog.Rules[rule]
+	if pc < 0 {
+		return false
+	}
+	code := prog.Code
+	m.stack = append(m.stack[:0], machineEntry{addr: -1, position: -1, thunkPos: m.thunkPos})
+	position0, thunkPos0 := m.Position, m.thunkPos
+	position := m.Position
+
+	var ruleAt map[int]int
+	callee := func(e machineEntry) int {
+		if e.addr < 0 {
+			return rule
+		}
+		return ruleAt[code[e.addr-1].Arg()]
+	}
+	if m.Tracer != nil {
+		ruleAt = make(map[int]int, len(prog.Rules))
+		for id, addr := range prog.Rules {
+			ruleAt[addr] = id
+		}
+		m.Tracer.Enter(rule, position)
+	}
+	for {
+		switch {
+		case m.Budget > 0:
+			if m.Budget--; m.Budget == 0 {
+				m.Budget = -1
+			}
+		case m.Budget < 0:
+			panic("peg: budget of machine steps exhausted")
+		}
+		inst := code[pc]
+		pc++
+		switch inst.Op() {
+		case OpAny:
+			if position < len(buffer) {
+				position++
+				continue
+			}
+		case OpChar:
+			if position < len(buffer) && buffer[position] == byte(inst.Arg()) {
+				position++
+				continue
+			}
+		case OpSet:
+			if position < len(buffer) {
+				c := buffer[position]
+				if prog.Classes[inst.Arg()][c>>3]&(1<<(c&7)) != 0 {
+					position++
+					continue
+				}
+			}
+		case OpString:
+			s := prog.Strings[inst.Arg()]
+			if next := position + len(s); next <= len(buffer) && buffer[position:next] == s {
+				position = next
+				continue
+			}
+		case OpCall:
+			m.stack = append(m.stack, machineEntry{addr: pc, position: -1, thunkPos: m.thunkPos})
+			pc = inst.Arg()
+			if m.Tracer != nil {
+				m.Tracer.Enter(ruleAt[pc], position)
+			}
+			continue
+		case OpReturn:
+			e := m.stack[len(m.stack)-1]
+			m.stack = m.stack[:len(m.stack)-1]
+			if m.Tracer != nil {
+				m.Tracer.Leave(callee(e), position, true)
+			}
+			if e.addr < 0 {
+				m.Position = position
+				m.commit(buffer, host)
+				return true
+			}
+			pc = e.addr
+			continue
+		case OpJump:
+			pc = inst.Arg()
+			continue
+		case OpChoice:
+			m.stack = append(m.stack, machineEntry{addr: inst.Arg(), position: position, thunkPos: m.thunkPos})
+			continue
+		case OpCommit:
+			m.stack = m.stack[:len(m.stack)-1]
+			pc = inst.Arg()
+			continue
+		case OpPartialCommit:
+			e := &m.stack[len(m.stack)-1]
+			e.position = position
+			e.thunkPos = m.thunkPos
+			pc = inst.Arg()
+			continue
+		case OpBackCommit:
+			e := m.stack[len(m.stack)-1]
+			m.stack = m.stack[:len(m.stack)-1]
+			position, m.thunkPos = e.position, e.thunkPos
+			pc = inst.Arg()
+			continue
+		case OpFailTwice:
+			m.stack = m.stack[:len(m.stack)-1]
+			goto fail
+		case OpBegin:
+			m.begin = position
+			continue
+		case OpEnd:
+			m.end = position
+			continue
+		case OpDo:
+			m.doarg(inst.Arg(), 0)
+			continue
+		case OpDoArg:
+			m.doarg(inst.Arg(), code[pc].Arg())
+			pc++
+			continue
+		case OpCut:
+			m.stack = append(m.stack, machineEntry{addr: m.Max, position: -2, thunkPos: m.thunkPos})
+			m.Max = position
+			continue
+		case OpCutEnd:
+			e := m.stack[len(m.stack)-1]
+			m.stack = m.stack[:len(m.stack)-1]
+			if e.addr > m.Max {
+				m.Max = e.addr
+			}
+			continue
+		case OpKeyword, OpIdent:
+			// the word rule has matched since the backtrack
+			// entry has been pushed; its thunks are dropped
+			e := &m.stack[len(m.stack)-1]
+			word := buffer[e.position:position]
+			if inst.Op() == OpKeyword && word == prog.Strings[inst.Arg()] ||
+				inst.Op() == OpIdent && !prog.isKeyword(inst.Arg(), word) {
+				m.thunkPos = e.thunkPos
+				continue
+			}
+			if e.position >= m.Max {
+				m.Max = e.position
+			}
+			goto fail
+		case OpPosition:
+			m.doarg(inst.Arg(), 0)
+			t := &m.thunks[m.thunkPos-1]
+			t.begin, t.end = position, position
+			continue
+		case OpPredicate:
+			m.Position = position
+			if host.Predicate(inst.Arg()) {
+				continue
+			}
+			goto fail
+		case OpThunks:
+			for i := len(m.stack) - 1; i >= 0; i-- {
+				if e := &m.stack[i]; e.position == -1 {
+					if e.thunkPos != 0 {
+						goto fail
+					}
+					break
+				}
+			}
+			m.Position = position
+			m.commit(buffer, host)
+			continue
+		case OpFail:
+			goto fail
+		}
+
+		// a terminal did not match
+		if position >= m.Max {
+			m.Max = position
+			if t := m.trace; t != nil && !t.done && position >= t.max {
+				for _, e := range m.stack[1:] {
+					if e.position == -1 {
+						t.calls = append(t.calls, code[e.addr-1].Arg())
+					}
+				}
+				t.done = true
+			}
+		}
+	fail:
+		for cut := false; ; {
+			if len(m.stack) == 0 {
+				m.Position, m.thunkPos = position0, thunkPos0
+				return false
+			}
+			e := m.stack[len(m.stack)-1]
+			m.stack = m.stack[:len(m.stack)-1]
+			switch {
+			case e.position == -2:
+				cut = true // fail without backtracking
+			case e.position >= 0 && !cut:
+				position, m.thunkPos = e.position, e.thunkPos
+				pc = e.addr
+				break fail
+			case e.position == -1 && m.Tracer != nil:
+				m.Tracer.Leave(callee(e), position, false)
+			}
+		}
+	}
+}
+
+// Trace repeats a Run of rule that has failed, without executing
+// actions, and returns the rules that were active when the farthest
+// failure occurred, starting with rule. The state of m is preserved.
+func (m *Machine) Trace(prog *Program, rule int, buffer string, host Host) (rules []int) {
+	position, thunkPos, min, max, tracer := m.Position, m.thunkPos, m.Min, m.Max, m.Tracer
+	t := &machineTrace{max: max}
+	m.trace = t
+	m.Max = 0
+	m.Tracer = nil
+	m.Run(prog, rule, buffer, host)
+	m.trace = nil
+	m.Position, m.thunkPos, m.Min, m.Max, m.Tracer = position, thunkPos, min, max, tracer
+	if !t.done {
+		return nil
+	}
+	ruleAt := make(map[int]int, len(prog.Rules))
+	for id, addr := range prog.Rules {
+		ruleAt[addr] = id
+	}
+	rules = append(rules, rule)
+	for _, addr := range t.calls {
+		rules = append(rules, ruleAt[addr])
+	}
+	return
+}
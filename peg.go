@@ -10,6 +10,8 @@ import (
 	"io"
 	"log"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
 )
@@ -26,9 +28,12 @@ const (
 	TypeDot
 	TypeCharacter
 	TypeString
+	TypeKeyword
+	TypeIdent
 	TypeClass
 	TypePredicate
 	TypeCommit
+	TypeCut
 	TypeBegin
 	TypeEnd
 	TypeAction
@@ -58,7 +63,16 @@ type Rule interface {
 	Node
 	GetId() int
 	GetExpression() Node
-	SetExpression(e Node)
+
+	// ValueType returns the Go type of the rule's semantic value,
+	// or "", if it has not been specified.
+	ValueType() string
+
+	// Variables returns the names of the variables
+	// defined within the rule, in the order of their appearance.
+	Variables() []string
+
+	HasActions() bool
 }
 
 type rule struct {
@@ -66,7 +80,11 @@ type rule struct {
 	id         int
 	expression Node
 	hasActions bool
-	variables  map[string]*variable
+	variables  []*variable
+	typ        string
+	vtype      int
+	frame      []int
+	helper     bool // shares a subexpression of other rules, see shareSubexpressions
 }
 
 func (r *rule) GetType() Type {
@@ -84,14 +102,25 @@ func (r *rule) GetExpression() Node {
 	return r.expression
 }
 
-func (r *rule) SetExpression(e Node) {
-	r.expression = e
-}
-
 func (r *rule) String() string {
 	return r.name
 }
 
+func (r *rule) ValueType() string {
+	return r.typ
+}
+
+func (r *rule) Variables() (names []string) {
+	for _, v := range r.variables {
+		names = append(names, v.name)
+	}
+	return
+}
+
+func (r *rule) HasActions() bool {
+	return r.hasActions
+}
+
 func (r *rule) GoString() string {
 	b := []byte(r.String())
 	for i := 0; i < len(b); i++ {
@@ -103,13 +132,19 @@ func (r *rule) GoString() string {
 }
 
 type variable struct {
-	name   string
-	offset int
+	name    string
+	offset  int
+	vtype   int
+	capture bool // the variable stores the text of a named capture
 }
 
 /* Used to represent TypeName */
 type Name interface {
 	Node
+
+	// Variable returns the name of the variable the
+	// referenced rule's value is bound to, or "".
+	Variable() string
 }
 
 type name struct {
@@ -122,6 +157,13 @@ func (t *name) String() string {
 	return t.string
 }
 
+func (t *name) Variable() string {
+	if t.varp == nil {
+		return ""
+	}
+	return t.varp.name
+}
+
 /* Used to represent TypeDot, TypeCharacter, TypeString, TypeClass, TypePredicate, and TypeNil. */
 type Token interface {
 	Node
@@ -166,20 +208,38 @@ func (a *action) String() string {
 }
 
 func (a *action) Code() (s string) {
-	vmap := a.rule.variables
+	vars := a.rule.variables
 	ind := "\t\t\t"
-	off := 0
-	for _, v := range vmap {
-		off--
-		if v.offset == 0 {
-			v.offset = off
+	text := a.text
+	if len(vars) == 0 {
+		if a.rule.vtype >= 0 {
+			text = strings.Replace(text, "$$", fmt.Sprintf("p.yy%d.yy", a.rule.vtype), -1)
 		}
-		s += fmt.Sprintf(ind+"%s := yyval[yyp%d]\n", v.name, v.offset)
+		return fmt.Sprintf(ind+"%v\n", text)
 	}
-	s += fmt.Sprintf(ind+"%v\n", a)
-	for _, v := range vmap {
-		s += fmt.Sprintf(ind+"yyval[yyp%d] = %s\n", v.offset, v.name)
+
+	// Variables are declared within a block of their own, so that
+	// they may shadow the parser `p'; the value stacks are accessed
+	// through aliases.
+	alias := make(map[int]bool)
+	for _, v := range append(vars, &variable{vtype: a.rule.vtype}) {
+		if v.vtype >= 0 && !alias[v.vtype] {
+			alias[v.vtype] = true
+			s += fmt.Sprintf(ind+"yy%d := &p.yy%d\n", v.vtype, v.vtype)
+		}
 	}
+	s += ind + "{\n"
+	for _, v := range vars {
+		s += fmt.Sprintf(ind+"\t%s := yy%d.val[yy%d.p%d]\n", v.name, v.vtype, v.vtype, v.offset)
+	}
+	if a.rule.vtype >= 0 {
+		text = strings.Replace(text, "$$", fmt.Sprintf("yy%d.yy", a.rule.vtype), -1)
+	}
+	s += fmt.Sprintf(ind+"\t%v\n", text)
+	for _, v := range vars {
+		s += fmt.Sprintf(ind+"\tyy%d.val[yy%d.p%d] = %s\n", v.vtype, v.vtype, v.offset, v.name)
+	}
+	s += ind + "}\n"
 	return
 }
 
@@ -195,25 +255,50 @@ func (a *action) GetRule() string {
 
 type List interface {
 	Node
-	SetType(t Type)
 
-	Init() *list.List
-	Front() *list.Element
-	PushBack(value interface{}) *list.Element
+	// Len returns the number of sub-expressions of the list.
 	Len() int
+
+	// Items returns the sub-expressions of the list.
+	Items() []Node
+
+	setType(t Type)
+	init()
+	front() *list.Element
+	pushBack(value interface{}) *list.Element
 }
 
 type nodeList struct {
 	Type
-	list.List
+	elements list.List
 }
 
-func (l *nodeList) SetType(t Type) {
+func (l *nodeList) setType(t Type) {
 	l.Type = t
 }
 
+func (l *nodeList) Len() int {
+	return l.elements.Len()
+}
+
+func (l *nodeList) Items() (items []Node) {
+	for element := l.elements.Front(); element != nil; element = element.Next() {
+		items = append(items, element.Value.(Node))
+	}
+	return
+}
+
+func (l *nodeList) init()                                    { l.elements.Init() }
+func (l *nodeList) front() *list.Element                     { return l.elements.Front() }
+func (l *nodeList) pushBack(value interface{}) *list.Element { return l.elements.PushBack(value) }
+func (l *nodeList) pushFront(value interface{})              { l.elements.PushFront(value) }
+func (l *nodeList) remove(element *list.Element)             { l.elements.Remove(element) }
+func (l *nodeList) insertAfter(value interface{}, mark *list.Element) *list.Element {
+	return l.elements.InsertAfter(value, mark)
+}
+
 func (l *nodeList) String() string {
-	i := l.List.Front()
+	i := l.elements.Front()
 	s := "(" + i.Value.(fmt.Stringer).String()
 	for i = i.Next(); i != nil; i = i.Next() {
 		s += " / " + i.Value.(fmt.Stringer).String()
@@ -231,6 +316,9 @@ func (c *characterClass) copy() (class *characterClass) {
 }
 func (c *characterClass) add(character uint8)      { c[character>>3] |= (1 << (character & 7)) }
 func (c *characterClass) has(character uint8) bool { return c[character>>3]&(1<<(character&7)) != 0 }
+
+// Contains reports whether the class matches the character.
+func (c *characterClass) Contains(character byte) bool { return c.has(character) }
 func (c *characterClass) complement() {
 	for i := range *c {
 		c[i] = ^c[i]
@@ -324,20 +412,34 @@ type classEntry struct {
 
 /* A tree data structure into which a PEG can be parsed. */
 type Tree struct {
-	rules      map[string]*rule
-	rulesCount map[string]uint
-	ruleId     int
-	varp       *variable
-	Headers    []string
-	trailers   []string
-	list.List
+	rules           map[string]*rule
+	rulesCount      map[string]uint
+	ruleId          int
+	varp            *variable
+	Headers         []string
+	trailers        []string
+	examples        []string
+	tests           []*TestCase
+	keywords        []*keywordSet
+	dispatch        map[Node]int  // the indices of the dispatch tables of unordered alternates
+	skipping        map[Node]bool // the cases of unordered alternates that skip preceding alternatives
+	dispatchTables  []string
+	longest         []string // rules whose literals are chosen by length, see SetLongest
+	tries           []*trie  // the alternates compiled into tries
+	ruleList        list.List
 	Actions         []*action
 	Classes         map[string]classEntry
 	defines         map[string]string
 	switchExcl      map[string]bool
-	stack           [1024]Node
-	top             int
+	valueTypes      []string
+	stack           []Node
 	inline, _switch bool
+	warnings        *[]string
+	err             error // the first error returned by AddExpression or SetTestFail
+	leftRecursive   []string
+	offsetFunc      func() int
+	offsets         map[Node]int // the offsets of rules and leaves within the source
+	cover           map[Node]int // the counters of the nodes in coverage mode
 }
 
 func New(inline, _switch bool) *Tree {
@@ -350,36 +452,199 @@ func New(inline, _switch bool) *Tree {
 			"userstate": "",
 			"yystype":   "yyStype",
 			"noexport":  "",
+			"bytes":     "",
+			"cover":     "",
 		},
 		inline:  inline,
 		_switch: _switch}
 }
 
+// warnf reports a problem with the grammar on os.Stderr, or
+// appends it to t.warnings, if set.
+func (t *Tree) warnf(format string, a ...interface{}) {
+	if t.warnings == nil {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+		return
+	}
+	*t.warnings = append(*t.warnings, fmt.Sprintf(format, a...))
+}
+
 func (t *Tree) push(n Node) {
-	t.top++
-	t.stack[t.top] = n
+	t.stack = append(t.stack, n)
 }
 
 func (t *Tree) pop() Node {
-	n := t.stack[t.top]
-	t.top--
+	n := t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
 	return n
 }
 
+// checkOperands returns an error if there are less than n
+// expressions on the top of the stack.
+func (t *Tree) checkOperands(op string, n int) error {
+	have := 0
+	for i := len(t.stack) - 1; i >= 0 && have < n; i-- {
+		if t.stack[i].GetType() == TypeRule {
+			break
+		}
+		have++
+	}
+	switch {
+	case have == n:
+		return nil
+	case n == 1:
+		return fmt.Errorf("peg: %s: no expression on the stack", op)
+	}
+	return fmt.Errorf("peg: %s: need %d expressions on the stack, found %d", op, n, have)
+}
+
 func (t *Tree) currentRule() *rule {
-	return t.stack[1].(*rule)
+	if len(t.stack) == 0 || t.stack[0].GetType() != TypeRule {
+		panic("peg: no current rule, missing AddRule")
+	}
+	return t.stack[0].(*rule)
+}
+
+// SetOffsetFunc sets a function that returns the offset of yytext
+// within the source of the grammar, e.g. using TextSpan. While f is
+// set, AddRule, AddName, AddString, AddClass, AddAction, and
+// AddPredicate record the offsets of the nodes they add, which are
+// used by coverage reports.
+func (t *Tree) SetOffsetFunc(f func() int) {
+	t.offsetFunc = f
+}
+
+// setOffset records the offset of node, which starts n bytes
+// before yytext.
+func (t *Tree) setOffset(node Node, n int) {
+	if t.offsetFunc == nil {
+		return
+	}
+	if t.offsets == nil {
+		t.offsets = make(map[Node]int)
+	}
+	t.offsets[node] = t.offsetFunc() - n
+}
+
+// Offset returns the offset of a rule, or of a name, literal, class,
+// action, or predicate, within the source of the grammar, if it has
+// been recorded, see SetOffsetFunc.
+func (t *Tree) Offset(node Node) (offset int, ok bool) {
+	offset, ok = t.offsets[node]
+	return
 }
 
 func (t *Tree) AddRule(name string) {
-	t.push(&rule{name: name, id: t.ruleId})
+	r := &rule{name: name, id: t.ruleId}
+	t.setOffset(r, 0)
+	t.push(r)
 	t.ruleId++
 }
 
-func (t *Tree) AddExpression() {
+// AddRuleType sets the Go type of the semantic value returned
+// by the current rule, i.e. the type of `$$' within its actions,
+// and of variables bound to the rule.
+func (t *Tree) AddRuleType(text string) {
+	t.currentRule().typ = text
+}
+
+// AddExpression completes the definition of the rule started by
+// AddRule. Exactly one expression, which becomes the
+// rule's expression, must have been added since then. Named
+// captures within the expression are resolved, see AddNamedBegin.
+func (t *Tree) AddExpression() (err error) {
+	defer func() {
+		if err != nil && t.err == nil {
+			t.err = err
+		}
+	}()
+	switch n := len(t.stack); {
+	case n == 0 || t.stack[0].GetType() != TypeRule:
+		return fmt.Errorf("peg: AddExpression: no rule, missing AddRule")
+	case n == 1:
+		return fmt.Errorf("peg: AddExpression: no expression for rule '%v'", t.stack[0])
+	case n > 2:
+		return fmt.Errorf("peg: AddExpression: %d expressions left for rule '%v', missing AddSequence or AddAlternate",
+			n-1, t.stack[0])
+	}
+	if err := t.resolveCaptures(t.stack[1]); err != nil {
+		return err
+	}
 	expression := t.pop()
-	rule := t.pop().(Rule)
-	rule.SetExpression(expression)
-	t.PushBack(rule)
+	rule := t.pop().(*rule)
+	rule.expression = expression
+	t.rules[rule.name] = rule
+	t.ruleList.PushBack(rule)
+	return nil
+}
+
+// Err returns the first error returned by AddExpression or
+// SetTestFail. It allows parsers of grammars, which usually ignore
+// the results of their actions, to check whether the rules and
+// test cases have been added successfully.
+func (t *Tree) Err() error {
+	return t.err
+}
+
+// Rules returns the rules of the grammar in the order of their
+// definition. After Compile it also contains rules that have been
+// used, but not defined.
+func (t *Tree) Rules() (rules []Rule) {
+	for element := t.ruleList.Front(); element != nil; element = element.Next() {
+		rules = append(rules, element.Value.(Rule))
+	}
+	return
+}
+
+// Rule returns the rule with the given name, or nil.
+func (t *Tree) Rule(name string) Rule {
+	if r := t.rules[name]; r != nil && r.name != "" {
+		return r
+	}
+	return nil
+}
+
+// RuleId returns the id of the named rule, which is the
+// value of the rule's constant in the generated source.
+func (t *Tree) RuleId(name string) (id int, ok bool) {
+	if r := t.Rule(name); r != nil {
+		return r.GetId(), true
+	}
+	return
+}
+
+// Uses returns how often the named rule is referenced
+// from within the expressions of other rules, or itself.
+func (t *Tree) Uses(name string) (n int) {
+	for element := t.ruleList.Front(); element != nil; element = element.Next() {
+		Walk(element.Value.(Node), func(node Node) {
+			if node.GetType() == TypeName && node.String() == name {
+				n++
+			}
+		})
+	}
+	return
+}
+
+// Defines returns a copy of the values set using Define.
+func (t *Tree) Defines() map[string]string {
+	m := make(map[string]string, len(t.defines))
+	for k, v := range t.defines {
+		m[k] = v
+	}
+	return m
+}
+
+// Trailers returns the texts added using AddTrailer,
+// in the order of their appearance in the grammar.
+func (t *Tree) Trailers() []string {
+	return t.trailers
+}
+
+// SwitchExcluded reports whether the rule has been
+// excluded from the switch optimization.
+func (t *Tree) SwitchExcluded(rule string) bool {
+	return t.switchExcl[rule]
 }
 
 func (t *Tree) AddHeader(text string) {
@@ -390,23 +655,75 @@ func (t *Tree) AddTrailer(text string) {
 	t.trailers = append(t.trailers, text)
 }
 
+// AddExample adds an example input of the grammar, given as the
+// contents of a string literal, as in `%example "a = 1\n"'.
+func (t *Tree) AddExample(text string) {
+	t.examples = append(t.examples, unescape(text))
+}
+
+// Examples returns the example inputs added using AddExample.
+func (t *Tree) Examples() []string {
+	return t.examples
+}
+
+// AddTest starts a test case of rule, as in `%test Expr "1+2" ok'.
+// The input is set using SetTestInput; the rule is expected to
+// match all of it, unless SetTestFail is called.
+func (t *Tree) AddTest(rule string) {
+	t.tests = append(t.tests, &TestCase{Rule: rule})
+}
+
+// SetTestInput sets the input of the current test case, given as
+// the contents of a string literal.
+func (t *Tree) SetTestInput(text string) {
+	t.tests[len(t.tests)-1].Input = unescape(text)
+}
+
+// SetTestFail marks the current test case as expected to fail. If pos
+// is not empty, it is the expected position of the failure, "line:column".
+func (t *Tree) SetTestFail(pos string) (err error) {
+	c := t.tests[len(t.tests)-1]
+	c.Fail = true
+	if pos != "" {
+		if _, err = fmt.Sscanf(pos, "%d:%d", &c.Line, &c.Column); err != nil {
+			err = fmt.Errorf("peg: SetTestFail: invalid position %q for rule '%s'", pos, c.Rule)
+			if t.err == nil {
+				t.err = err
+			}
+		}
+	}
+	return
+}
+
+// Tests returns the test cases added using AddTest.
+func (t *Tree) Tests() []*TestCase {
+	return t.tests
+}
+
 func (t *Tree) AddVariable(text string) {
 	var v *variable
 
 	r := t.currentRule()
-	if r.variables == nil {
-		r.variables = make(map[string]*variable)
+	for _, rv := range r.variables {
+		if rv.name == text {
+			v = rv
+			break
+		}
 	}
-	if v = r.variables[text]; v == nil {
+	if v == nil {
 		v = &variable{name: text}
+		r.variables = append(r.variables, v)
 	}
-	r.variables[text] = v
 	t.varp = v
 }
 
 func (t *Tree) AddName(text string) {
-	t.rules[text] = &rule{}
-	t.push(&name{Type: TypeName, string: text, varp: t.varp})
+	if t.rules[text] == nil {
+		t.rules[text] = &rule{}
+	}
+	n := &name{Type: TypeName, string: text, varp: t.varp}
+	t.setOffset(n, 0)
+	t.push(n)
 	t.varp = nil
 }
 
@@ -431,15 +748,24 @@ s:
 		}
 		fallthrough
 	default:
-		t.push(&token{Type: TypeString, string: text})
+		n := &token{Type: TypeString, string: text}
+		t.setOffset(n, 1)
+		t.push(n)
 		return
 	}
-	t.push(&token{Type: TypeCharacter, string: text})
+	n := &token{Type: TypeCharacter, string: text}
+	t.setOffset(n, 1)
+	t.push(n)
 }
 func (t *Tree) AddClass(text string) {
-	t.push(&token{Type: TypeClass, string: text})
-	if _, ok := t.Classes[text]; !ok {
+	n := &token{Type: TypeClass, string: text}
+	t.setOffset(n, 1)
+	t.push(n)
+	if e, ok := t.Classes[text]; ok {
+		n.class = e.Class
+	} else {
 		c := new(characterClass)
+		n.class = c
 		t.Classes[text] = classEntry{len(t.Classes), c}
 		inverse := false
 		if text[0] == '^' {
@@ -488,13 +814,33 @@ func (t *Tree) AddClass(text string) {
 	}
 }
 func (t *Tree) AddPredicate(text string) {
-	t.push(&token{Type: TypePredicate, string: strings.TrimSpace(text)})
+	p := &token{Type: TypePredicate, string: strings.TrimSpace(text)}
+	t.setOffset(p, 2)
+	t.push(p)
 }
 
 var commit *token = &token{Type: TypeCommit, string: "commit"}
 
 func (t *Tree) AddCommit() { t.push(commit) }
 
+var cut *token = &token{Type: TypeCut, string: "~"}
+
+// AddCut adds a cut. Once it has been passed, a failure of the
+// remaining expressions of the sequence containing it is not
+// backtracked from, but ends the parse with an error at the farthest
+// position at which a match failed after the cut.
+func (t *Tree) AddCut() { t.push(cut) }
+
+// hasCuts returns whether a rule contains a cut.
+func (t *Tree) hasCuts() (found bool) {
+	for _, r := range t.Rules() {
+		Walk(r.GetExpression(), func(node Node) {
+			found = found || node.GetType() == TypeCut
+		})
+	}
+	return
+}
+
 var begin *token = &token{Type: TypeBegin, string: "<"}
 
 func (t *Tree) AddBegin() { t.push(begin) }
@@ -502,17 +848,71 @@ func (t *Tree) AddBegin() { t.push(begin) }
 var end *token = &token{Type: TypeEnd, string: ">"}
 
 func (t *Tree) AddEnd() { t.push(end) }
+
+// A namedBegin marks the beginning of a named capture, `<@name:'.
+type namedBegin struct {
+	name string
+}
+
+func (b *namedBegin) GetType() Type  { return TypeBegin }
+func (b *namedBegin) String() string { return "<@" + b.name + ":" }
+
+// AddNamedBegin starts a named capture, `<@name:'. It is closed by
+// the next `>' within the same sequence; the text matched in between
+// is stored into a variable of the current rule called name.
+func (t *Tree) AddNamedBegin(name string) { t.push(&namedBegin{name: name}) }
+
+// resolveCaptures replaces each named capture within node, an
+// expression of the current rule, by a capture followed by an action,
+// which stores yytext into the capture's variable while begin and end
+// still refer to it.
+func (t *Tree) resolveCaptures(node Node) (err error) {
+	r := t.currentRule()
+	Walk(node, func(node Node) {
+		if node.GetType() != TypeSequence {
+			return
+		}
+		var start *list.Element
+		l := node.(*nodeList)
+		for el := l.front(); el != nil; el = el.Next() {
+			switch x := el.Value.(Node); {
+			case start == nil:
+				if _, ok := x.(*namedBegin); ok {
+					start = el
+				}
+			case x == end:
+				t.AddVariable(start.Value.(*namedBegin).name)
+				t.varp.capture = true
+				a := &action{text: " " + t.varp.name + " = yytext ", id: len(t.Actions), rule: r}
+				t.varp = nil
+				r.hasActions = true
+				t.Actions = append(t.Actions, a)
+				start.Value = begin
+				el = l.insertAfter(a, el)
+				start = nil
+			default:
+				Walk(x, func(node Node) {
+					if node.GetType() == TypeBegin && err == nil {
+						err = fmt.Errorf("peg: rule '%v': capture '%v' must not contain other captures", r, start.Value)
+					}
+				})
+			}
+		}
+	})
+	Walk(node, func(node Node) {
+		if _, ok := node.(*namedBegin); ok && err == nil {
+			err = fmt.Errorf("peg: rule '%v': capture '%v' is not closed", r, node)
+		}
+	})
+	return
+}
+
 func (t *Tree) AddNil() { t.push(nilNode) }
 func (t *Tree) AddAction(text string) {
-	b := []byte(text)
-	for i := 0; i < len(b)-1; i++ {
-		if b[i] == '$' && b[i+1] == '$' {
-			b[i], b[i+1] = 'y', 'y'
-		}
-	}
-	a := &action{text: string(b), id: len(t.Actions), rule: t.currentRule()}
+	a := &action{text: text, id: len(t.Actions), rule: t.currentRule()}
 	t.currentRule().hasActions = true
 	t.Actions = append(t.Actions, a)
+	t.setOffset(a, 1)
 	t.push(a)
 }
 func (t *Tree) Define(name, text string) {
@@ -527,7 +927,10 @@ func (t *Tree) SwitchExclude(rule string) {
 	t.switchExcl[rule] = true
 }
 
-func (t *Tree) addList(listType Type) {
+func (t *Tree) addList(op string, listType Type) error {
+	if err := t.checkOperands(op, 2); err != nil {
+		return err
+	}
 	a := t.pop()
 	b := t.pop()
 	var l List
@@ -535,24 +938,29 @@ func (t *Tree) addList(listType Type) {
 		l = b.(List)
 	} else {
 		l = &nodeList{Type: listType}
-		l.PushBack(b)
+		l.pushBack(b)
 	}
-	l.PushBack(a)
+	l.pushBack(a)
 	t.push(l)
+	return nil
 }
-func (t *Tree) AddAlternate() { t.addList(TypeAlternate) }
-func (t *Tree) AddSequence()  { t.addList(TypeSequence) }
+func (t *Tree) AddAlternate() error { return t.addList("AddAlternate", TypeAlternate) }
+func (t *Tree) AddSequence() error  { return t.addList("AddSequence", TypeSequence) }
 
-func (t *Tree) addFix(fixType Type) {
+func (t *Tree) addFix(op string, fixType Type) error {
+	if err := t.checkOperands(op, 1); err != nil {
+		return err
+	}
 	n := &nodeList{Type: fixType}
-	n.PushBack(t.pop())
+	n.pushBack(t.pop())
 	t.push(n)
+	return nil
 }
-func (t *Tree) AddPeekFor() { t.addFix(TypePeekFor) }
-func (t *Tree) AddPeekNot() { t.addFix(TypePeekNot) }
-func (t *Tree) AddQuery()   { t.addFix(TypeQuery) }
-func (t *Tree) AddStar()    { t.addFix(TypeStar) }
-func (t *Tree) AddPlus()    { t.addFix(TypePlus) }
+func (t *Tree) AddPeekFor() error { return t.addFix("AddPeekFor", TypePeekFor) }
+func (t *Tree) AddPeekNot() error { return t.addFix("AddPeekNot", TypePeekNot) }
+func (t *Tree) AddQuery() error   { return t.addFix("AddQuery", TypeQuery) }
+func (t *Tree) AddStar() error    { return t.addFix("AddStar", TypeStar) }
+func (t *Tree) AddPlus() error    { return t.addFix("AddPlus", TypePlus) }
 
 func join(tasks []func()) {
 	length := len(tasks)
@@ -569,19 +977,17 @@ var anyChar = func() (c *characterClass) {
 	return
 }()
 
-func (t *Tree) Compile(out io.Writer, optiFlags string) {
-	counts := [TypeLast]uint{}
-	nvar := 0
-
-	O := parseOptiFlags(optiFlags)
-
-	for element := t.Front(); element != nil; element = element.Next() {
+// resolve adds undefined rules referred to by name to the tree,
+// assigns value types, counts how often rules are referenced,
+// and warns about possible left recursion. It is common to
+// both backends, Compile and CompileVM.
+func (t *Tree) resolve() {
+	for element := t.ruleList.Front(); element != nil; element = element.Next() {
 		node := element.Value.(Node)
 		switch node.GetType() {
 		case TypeRule:
 			rule := node.(*rule)
 			t.rules[rule.String()] = rule
-			nvar += len(rule.variables)
 		}
 	}
 	for name, r := range t.rules {
@@ -589,34 +995,17 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			r := &rule{name: name, id: t.ruleId}
 			t.ruleId++
 			t.rules[name] = r
-			t.PushBack(r)
+			t.ruleList.PushBack(r)
 		}
 	}
+	t.resolveLongest()
+	t.resolveKeywords()
+	t.setValueTypes()
 
 	join([]func(){
-		func() {
-			var countTypes func(node Node)
-			countTypes = func(node Node) {
-				t := node.GetType()
-				counts[t]++
-				switch t {
-				case TypeRule:
-					countTypes(node.(Rule).GetExpression())
-				case TypeAlternate, TypeUnorderedAlternate, TypeSequence:
-					for element := node.(List).Front(); element != nil; element = element.Next() {
-						countTypes(element.Value.(Node))
-					}
-				case TypePeekFor, TypePeekNot, TypeQuery, TypeStar, TypePlus:
-					countTypes(node.(List).Front().Value.(Node))
-				}
-			}
-			for _, rule := range t.rules {
-				countTypes(rule)
-			}
-		},
 		func() {
 			var countRules func(node Node)
-			ruleReached := make([]bool, len(t.rules))
+			ruleReached := make([]bool, t.ruleId)
 			countRules = func(node Node) {
 				switch node.GetType() {
 				case TypeRule:
@@ -634,15 +1023,21 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 					countRules(rule.GetExpression())
 				case TypeName:
 					countRules(t.rules[node.String()])
+				case TypeKeyword, TypeIdent:
+					// the word rule is called from generated
+					// code, and thus must not be inlined
+					word := node.(*keyword).set.word
+					t.rulesCount[word]++
+					countRules(t.rules[word])
 				case TypeAlternate, TypeUnorderedAlternate, TypeSequence:
-					for element := node.(List).Front(); element != nil; element = element.Next() {
+					for element := node.(List).front(); element != nil; element = element.Next() {
 						countRules(element.Value.(Node))
 					}
 				case TypePeekFor, TypePeekNot, TypeQuery, TypeStar, TypePlus:
-					countRules(node.(List).Front().Value.(Node))
+					countRules(node.(List).front().Value.(Node))
 				}
 			}
-			for element := t.Front(); element != nil; element = element.Next() {
+			for element := t.ruleList.Front(); element != nil; element = element.Next() {
 				node := element.Value.(Node)
 				if node.GetType() == TypeRule {
 					countRules(node.(*rule))
@@ -652,14 +1047,15 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 		},
 		func() {
 			var checkRecursion func(node Node) bool
-			ruleReached := make([]bool, len(t.rules))
+			ruleReached := make([]bool, t.ruleId)
 			checkRecursion = func(node Node) bool {
 				switch node.GetType() {
 				case TypeRule:
 					rule := node.(Rule)
 					id := rule.GetId()
 					if ruleReached[id] {
-						fmt.Fprintf(os.Stderr, "possible infinite left recursion in rule '%v'\n", node)
+						t.warnf("possible infinite left recursion in rule '%v'", node)
+						t.leftRecursive = append(t.leftRecursive, node.String())
 						return false
 					}
 					ruleReached[id] = true
@@ -667,25 +1063,27 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 					ruleReached[id] = false
 					return consumes
 				case TypeAlternate:
-					for element := node.(List).Front(); element != nil; element = element.Next() {
+					for element := node.(List).front(); element != nil; element = element.Next() {
 						if !checkRecursion(element.Value.(Node)) {
 							return false
 						}
 					}
 					return true
 				case TypeSequence:
-					for element := node.(List).Front(); element != nil; element = element.Next() {
+					for element := node.(List).front(); element != nil; element = element.Next() {
 						if checkRecursion(element.Value.(Node)) {
 							return true
 						}
 					}
 				case TypeName:
 					return checkRecursion(t.rules[node.String()])
+				case TypeIdent:
+					return checkRecursion(t.rules[node.String()])
 				case TypePlus:
-					return checkRecursion(node.(List).Front().Value.(Node))
+					return checkRecursion(node.(List).front().Value.(Node))
 				case TypeCharacter, TypeString:
 					return len(node.String()) > 0
-				case TypeDot, TypeClass:
+				case TypeDot, TypeClass, TypeKeyword:
 					return true
 				}
 				return false
@@ -695,6 +1093,32 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			}
 		}})
 
+}
+
+// Compile writes a parser for the grammar to out. Nothing is
+// written if the grammar contains errors, like a variable bound
+// to rules of different types; the first of them is returned.
+func (t *Tree) Compile(out io.Writer, optiFlags string) error {
+	O := parseOptiFlags(optiFlags)
+	var generated byteCounter
+	var unshared int
+	if O.size && Verbose {
+		out = io.MultiWriter(out, &generated)
+		unshared = t.unsharedSize(optiFlags)
+	}
+
+	t.resolve()
+	if t.err != nil {
+		return t.err
+	}
+
+	// In coverage mode, the nodes counted must not be
+	// replaced or restructured by optimizations.
+	cover := t.defines["cover"] != ""
+	if cover {
+		O.inlineLeafs = false
+	}
+
 	var inlineLeafes func(node Node) Node
 	inlineLeafes = func(node Node) (ret Node) {
 		ret = node
@@ -705,12 +1129,17 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			case TypeCharacter, TypeDot, TypeClass, TypeString:
 				ret = x
 			case TypePlus, TypeStar, TypeQuery, TypePeekNot, TypePeekFor:
-				switch x.(List).Front().Value.(Node).GetType() {
+				switch x.(List).front().Value.(Node).GetType() {
 				case TypeCharacter, TypeDot, TypeClass, TypeString:
 					ret = x
 				}
 			}
 		case TypeName:
+			if node.(*name).varp != nil {
+				// keep the rule call, so that its value
+				// gets stored into the variable
+				break
+			}
 			r := t.rules[node.String()]
 			x := inlineLeafes(r)
 			if r != x {
@@ -718,11 +1147,11 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 				ret = x
 			}
 		case TypeSequence, TypeAlternate:
-			for el := node.(List).Front(); el != nil; el = el.Next() {
+			for el := node.(List).front(); el != nil; el = el.Next() {
 				el.Value = inlineLeafes(el.Value.(Node))
 			}
 		case TypePlus, TypeStar, TypeQuery, TypePeekNot, TypePeekFor:
-			v := &node.(List).Front().Value
+			v := &node.(List).front().Value
 			*v = inlineLeafes((*v).(Node))
 		}
 		return
@@ -732,8 +1161,18 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			inlineLeafes(rule.GetExpression())
 		}
 	}
+	var size sizeStats
+	if O.size && !cover {
+		t.shareSubexpressions(&size)
+		t.shareClasses(&size)
+	}
+	t.tries, t.dispatch, t.dispatchTables = nil, nil, nil
+	t.skipping = make(map[Node]bool)
+	if O.tries && !cover {
+		t.findTries()
+	}
 
-	if t._switch {
+	if t._switch && !cover {
 		var optimizeAlternates func(node Node) (consumes, eof, peek bool, class *characterClass)
 		cache := make([]struct {
 			reached, consumes, eof, peek bool
@@ -757,8 +1196,11 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 				cache.reached = true
 				consumes, eof, peek, class = optimizeAlternates(rule.GetExpression())
 				cache.consumes, cache.eof, cache.peek, cache.class = consumes, eof, peek, class
-			case TypeName:
+			case TypeName, TypeIdent:
 				consumes, eof, peek, class = optimizeAlternates(t.rules[node.String()])
+			case TypeKeyword:
+				consumes, class = true, new(characterClass)
+				class.add(node.String()[0])
 			case TypeDot:
 				consumes, class = true, new(characterClass)
 				for index, _ := range *class {
@@ -770,126 +1212,92 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 					return
 				}
 				consumes, class = true, new(characterClass)
-				b := node.String()[0]
-				if b == '\\' {
-					b = node.String()[1]
-					switch b {
-					case 'a':
-						b = '\a' /* bel */
-					case 'b':
-						b = '\b' /* bs */
-					case 'f':
-						b = '\f' /* ff */
-					case 'n':
-						b = '\n' /* nl */
-					case 'r':
-						b = '\r' /* cr */
-					case 't':
-						b = '\t' /* ht */
-					case 'v':
-						b = '\v' /* vt */
-					default:
-						if s := node.String(); len(s) == 4 {
-							b = (s[1]-'0')*64 + (s[2]-'0')*8 + s[3] - '0'
-						}
-					}
-				}
-				class.add(b)
+				class.add(unescape(node.String())[0])
 			case TypeClass:
 				consumes, class = true, t.Classes[node.String()].Class
 			case TypeAlternate:
+				if t.trie(node) != nil {
+					// the literals are matched by a trie, and must not be rearranged
+					consumes, class = true, new(characterClass)
+					for _, x := range node.(List).Items() {
+						_, _, _, c := optimizeAlternates(x)
+						class.union(c)
+					}
+					break
+				}
 				consumes, peek, class = true, true, new(characterClass)
 				alternate := node.(List)
-				mconsumes, meof, mpeek, properties, c :=
-					consumes, eof, peek, make([]struct {
-						intersects bool
-						class      *characterClass
-					}, alternate.Len()), 0
-				empty := false
-				for element := alternate.Front(); element != nil; element = element.Next() {
-					mconsumes, meof, mpeek, properties[c].class = optimizeAlternates(element.Value.(Node))
+				mconsumes, meof, mpeek, classes, c :=
+					consumes, eof, peek, make([]*characterClass, alternate.Len()), 0
+				empty, unknown := false, false
+				for element := alternate.front(); element != nil; element = element.Next() {
+					mconsumes, meof, mpeek, classes[c] = optimizeAlternates(element.Value.(Node))
 					consumes, eof, peek = consumes && mconsumes, eof || meof, peek && mpeek
-					if properties[c].class != nil {
-						class.union(properties[c].class)
-						if properties[c].class.len() == 0 {
+					if classes[c] != nil {
+						class.union(classes[c])
+						if classes[c].len() == 0 {
 							empty = true
 						}
+					} else {
+						unknown = true
 					}
 					c++
 				}
-				if eof {
+				if eof || unknown {
 					break
 				}
-				intersections := 0
-			compare:
-				for ai, a := range properties[0 : len(properties)-1] {
-					for _, b := range properties[ai+1:] {
-						for i, v := range *a.class {
-							if (b.class[i] & v) != 0 {
-								intersections++
-								properties[ai].intersects = true
-								continue compare
-							}
-						}
-					}
-				}
 				if empty {
 					class = new(characterClass)
 					consumes = false
 					break
 				}
-				if intersections < len(properties) && len(properties) >= 2 {
-					c, unordered, ordered, max :=
-						0, &nodeList{Type: TypeUnorderedAlternate}, &nodeList{Type: TypeAlternate}, 0
-					for element := alternate.Front(); element != nil; element = element.Next() {
-						if properties[c].intersects {
-							ordered.PushBack(element.Value)
-						} else {
-							class := &token{Type: TypeClass, string: properties[c].class.String(), class: properties[c].class}
-
-							sequence, predicate, length :=
-								&nodeList{Type: TypeSequence}, &nodeList{Type: TypePeekFor}, properties[c].class.len()
-							predicate.PushBack(class)
-							sequence.PushBack(predicate)
-							sequence.PushBack(element.Value)
-
-							if element.Value.(Node).GetType() == TypeString && element.Value.(Node).String() == "" {
-								unordered.PushBack(sequence)
-							} else if element.Value.(Node).GetType() == TypeNil {
-								unordered.PushBack(sequence)
-							} else if length > max {
-								unordered.PushBack(sequence)
-								max = length
-							} else {
-								unordered.PushFront(sequence)
-							}
+				groups := dispatchGroups(classes)
+				if len(groups) == 1 && len(groups[0].alternatives) == len(classes) || copies(groups) > 2*len(classes) {
+					// nothing to gain, or too much code duplicated
+					break
+				}
+				items, unordered, max := alternate.Items(), &nodeList{Type: TypeUnorderedAlternate}, 0
+				for _, g := range groups {
+					var x Node
+					if len(g.alternatives) == 1 {
+						x = items[g.alternatives[0]]
+					} else {
+						ordered := &nodeList{Type: TypeAlternate}
+						for _, i := range g.alternatives {
+							ordered.pushBack(items[i])
 						}
-						c++
+						x = ordered
 					}
-					alternate.Init()
-					if ordered.Len() == 0 {
-						alternate.SetType(TypeUnorderedAlternate)
-						for element := unordered.Front(); element != nil; element = element.Next() {
-							alternate.PushBack(element.Value)
-						}
+					class := &token{Type: TypeClass, string: g.class.String(), class: g.class}
+
+					sequence, predicate, length :=
+						&nodeList{Type: TypeSequence}, &nodeList{Type: TypePeekFor}, g.class.len()
+					predicate.pushBack(class)
+					sequence.pushBack(predicate)
+					sequence.pushBack(x)
+					if g.alternatives[0] > 0 {
+						t.skipping[sequence] = true
+					}
+
+					if length > max {
+						unordered.pushBack(sequence)
+						max = length
 					} else {
-						for element := ordered.Front(); element != nil; element = element.Next() {
-							alternate.PushBack(element.Value)
-						}
-						if unordered.Len() == 1 {
-							alternate.PushBack(unordered.Front().Value.(List).Front().Next().Value)
-						} else {
-							alternate.PushBack(unordered)
-						}
+						unordered.pushFront(sequence)
 					}
 				}
+				alternate.init()
+				alternate.setType(TypeUnorderedAlternate)
+				for element := unordered.front(); element != nil; element = element.Next() {
+					alternate.pushBack(element.Value)
+				}
 			case TypeSequence:
 				sequence := node.(List)
 				meof, classes, c, element :=
 					eof, make([]struct {
 						peek  bool
 						class *characterClass
-					}, sequence.Len()), 0, sequence.Front()
+					}, sequence.Len()), 0, sequence.front()
 				for ; !consumes && element != nil; element, c = element.Next(), c+1 {
 					consumes, meof, classes[c].peek, classes[c].class = optimizeAlternates(element.Value.(Node))
 					eof, peek = eof || meof, peek || classes[c].peek
@@ -910,7 +1318,7 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			case TypePeekNot:
 				peek = true
 				// might be buggy
-				_, eof, _, _ = optimizeAlternates(node.(List).Front().Value.(Node))
+				_, eof, _, _ = optimizeAlternates(node.(List).front().Value.(Node))
 				class = new(characterClass)
 				eof = !eof
 				class = class.copy()
@@ -919,15 +1327,15 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 				peek = true
 				fallthrough
 			case TypeQuery, TypeStar:
-				_, eof, _, class = optimizeAlternates(node.(List).Front().Value.(Node))
+				_, eof, _, class = optimizeAlternates(node.(List).front().Value.(Node))
 			case TypePlus:
-				consumes, eof, peek, class = optimizeAlternates(node.(List).Front().Value.(Node))
+				consumes, eof, peek, class = optimizeAlternates(node.(List).front().Value.(Node))
 			case TypeAction, TypeNil:
 				class = new(characterClass)
 			}
 			return
 		}
-		for element := t.Front(); element != nil; element = element.Next() {
+		for element := t.ruleList.Front(); element != nil; element = element.Next() {
 			node := element.Value.(Node)
 			if node.GetType() == TypeRule {
 				optimizeAlternates(node.(*rule))
@@ -936,6 +1344,13 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 		}
 	}
 
+	if cover {
+		t.cover = make(map[Node]int)
+		for i, node := range t.coverPoints() {
+			t.cover[node] = i
+		}
+	}
+
 	w := newWriter(out)
 	w.elimRestore = O.elimRestore
 	print := func(format string, a ...interface{}) {
@@ -945,91 +1360,28 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 	}
 
 	var printRule func(node Node)
-	var compile func(expression Node, ko *label) (chgFlags, chgFlags)
+	var compile, compileNode func(expression Node, ko *label) (chgFlags, chgFlags)
 	printRule = func(node Node) {
-		switch node.GetType() {
-		case TypeRule:
-			print("%v <- ", node)
-			expression := node.(Rule).GetExpression()
-			if expression != nilNode {
-				printRule(expression)
-			}
-		case TypeDot:
-			print(".")
-		case TypeName:
-			print("%v", node)
-		case TypeCharacter,
-			TypeString:
-			print("'%v'", node)
-		case TypeClass:
-			print("[%v]", node)
-		case TypePredicate:
-			print("&{%v}", node)
-		case TypeAction:
-			print("{%v}", node)
-		case TypeCommit:
-			print("commit")
-		case TypeBegin:
-			print("<")
-		case TypeEnd:
-			print(">")
-		case TypeAlternate:
-			print("(")
-			list := node.(List)
-			element := list.Front()
-			printRule(element.Value.(Node))
-			for element = element.Next(); element != nil; element = element.Next() {
-				print(" / ")
-				printRule(element.Value.(Node))
-			}
-			print(")")
-		case TypeUnorderedAlternate:
-			print("(")
-			element := node.(List).Front()
-			printRule(element.Value.(Node))
-			for element = element.Next(); element != nil; element = element.Next() {
-				print(" | ")
-				printRule(element.Value.(Node))
-			}
-			print(")")
-		case TypeSequence:
-			print("(")
-			element := node.(List).Front()
-			printRule(element.Value.(Node))
-			for element = element.Next(); element != nil; element = element.Next() {
-				print(" ")
-				printRule(element.Value.(Node))
-			}
-			print(")")
-		case TypePeekFor:
-			print("&")
-			printRule(node.(List).Front().Value.(Node))
-		case TypePeekNot:
-			print("!")
-			printRule(node.(List).Front().Value.(Node))
-		case TypeQuery:
-			printRule(node.(List).Front().Value.(Node))
-			print("?")
-		case TypeStar:
-			printRule(node.(List).Front().Value.(Node))
-			print("*")
-		case TypePlus:
-			printRule(node.(List).Front().Value.(Node))
-			print("+")
-		default:
-			fmt.Fprintf(os.Stderr, "illegal node type: %v\n", node.GetType())
+		if !w.dryRun {
+			writeNode(w, node)
 		}
 	}
 	compileExpression := func(rule *rule, ko *label) (cko, cok chgFlags) {
-		nvar := len(rule.variables)
-		if nvar > 0 {
-			w.lnPrint("doarg(yyPush, %d)", nvar)
+		for k, n := range rule.frame {
+			if n > 0 {
+				w.lnPrint("p.doarg(yyPush%d, %d)", k, n)
+			}
 		}
 		cko, cok = compile(rule.GetExpression(), ko)
-		if nvar > 0 {
-			w.lnPrint("doarg(yyPop, %d)", nvar)
-			cko.thPos = true
-			cok.thPos = true
+		for k, n := range rule.frame {
+			if n > 0 {
+				w.lnPrint("p.doarg(yyPop%d, %d)", k, n)
+				cko.thPos = true
+				cok.thPos = true
+			}
+		}
+		if id, ok := t.cover[rule]; ok {
+			w.lnPrint("p.cover(%d)", id)
 		}
 		return
 	}
@@ -1039,13 +1391,13 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 		}
 		switch node.GetType() {
 		case TypeDot:
-			label.cJump(jumpIfTrue, "(position < len(p.Buffer))")
+			label.cJump(jumpIfTrue, "(p.position < len(p.Buffer) || p.fail())")
 			stats.Peek.Dot++
 		case TypeCharacter:
-			label.cJump(jumpIfTrue, "peekChar('%v')", node)
+			label.cJump(jumpIfTrue, "p.peekChar('%v')", node)
 			stats.Peek.Char++
 		case TypeClass:
-			label.cJump(jumpIfTrue, "peekClass(%d)", t.Classes[node.String()].Index)
+			label.cJump(jumpIfTrue, "p.peekClass(%d)", t.Classes[node.String()].Index)
 			stats.Peek.Class++
 		case TypePredicate:
 			label.cJump(jumpIfTrue, "(%v)", node)
@@ -1055,6 +1407,13 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 		return true
 	}
 	compile = func(node Node, ko *label) (chgko, chgok chgFlags) {
+		chgko, chgok = compileNode(node, ko)
+		if id, ok := t.cover[node]; ok {
+			w.lnPrint("p.cover(%d)", id)
+		}
+		return
+	}
+	compileNode = func(node Node, ko *label) (chgko, chgok chgFlags) {
 		updateFlags := func(cko, cok chgFlags) (chgFlags, chgFlags) {
 			chgko, chgok = updateChgFlags(chgko, chgok, cko, cok)
 			return chgko, chgok
@@ -1063,7 +1422,7 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 		case TypeRule:
 			fmt.Fprintf(os.Stderr, "internal error #1 (%v)\n", node)
 		case TypeDot:
-			ko.cJump(false, "matchDot()")
+			ko.cJump(false, "p.matchDot()")
 			stats.Match.Dot++
 			chgok.pos = true
 		case TypeName:
@@ -1071,51 +1430,73 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			name := node.String()
 			rule := t.rules[name]
 			if t.inline && t.rulesCount[name] == 1 {
+				w.lnPrint("if p.trace != nil {")
+				w.lnPrint("\tp.trace.step()")
+				w.lnPrint("}")
 				chgko, chgok = compileExpression(rule, ko)
 			} else {
-				ko.cJump(false, "p.rules[rule%s]()", rule.GoString())
-				if len(rule.variables) != 0 || rule.hasActions {
+				if O.methods {
+					ko.cJump(false, "p.rule%s()", rule.GoString())
+				} else {
+					ko.cJump(false, "yyRules[rule%s](p)", rule.GoString())
+				}
+				if len(rule.variables) != 0 || rule.hasActions || rule.helper {
 					chgok.thPos = true
 				}
 				chgok.pos = true // safe guess
 			}
 			if varp != nil {
-				w.lnPrint("doarg(yySet, %d)", varp.offset)
+				w.lnPrint("p.doarg(yySet%d, %d)", varp.vtype, varp.offset)
 				chgok.thPos = true
 			}
 		case TypeCharacter:
-			ko.cJump(false, "matchChar('%v')", node)
+			ko.cJump(false, "p.matchChar('%v')", node)
 			stats.Match.Char++
 			chgok.pos = true
 		case TypeString:
 			if s := node.String(); s != "" {
-				ko.cJump(false, "matchString(\"%s\")", s)
+				ko.cJump(false, "p.matchString(\"%s\")", s)
 				stats.Match.String++
 				chgok.pos = true
 			}
+		case TypeKeyword:
+			k := node.(*keyword)
+			ko.cJump(false, "p.matchKeyword(rule%s, %q)", t.rules[k.set.word].GoString(), k.string)
+			chgok.pos = true
+		case TypeIdent:
+			k := node.(*keyword)
+			ko.cJump(false, "p.matchIdent(rule%s, %d)", t.rules[k.set.word].GoString(), k.set.id)
+			chgok.pos = true
 		case TypeClass:
-			ko.cJump(false, "matchClass(%d)", t.Classes[node.String()].Index)
+			ko.cJump(false, "p.matchClass(%d)", t.Classes[node.String()].Index)
 			chgok.pos = true
 		case TypePredicate:
 			ko.cJump(false, "(%v)", node)
 		case TypeAction:
-			w.lnPrint("do(%d)", node.(Action).GetId())
+			w.lnPrint("p.do(%d)", node.(Action).GetId())
 			chgok.thPos = true
 		case TypeCommit:
 			ko.cJump(false, "(p.commit(thunkPosition0))")
 			chgko.thPos = true
+		case TypeCut:
+			// handled within sequences
 		case TypeBegin:
 			if t.Actions != nil {
-				w.lnPrint("begin = position")
+				w.lnPrint("p.begin = p.position")
 			}
 		case TypeEnd:
 			if t.Actions != nil {
-				w.lnPrint("end = position")
+				w.lnPrint("p.end = p.position")
 			}
 		case TypeAlternate:
+			if tr := t.trie(node); tr != nil {
+				ko.cJump(false, "p.matchTrie%d()", tr.id)
+				chgok.pos = true
+				break
+			}
 			list := node.(List)
 			ok := w.newLabel("ok")
-			element := list.Front()
+			element := list.front()
 			if ok.unsafe() {
 				w.begin()
 				ok.save()
@@ -1143,65 +1524,86 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			list := node.(List)
 			done, ok := ko, w.newLabel("ok")
 			w.begin()
-			done.cJump(true, "position == len(p.Buffer)")
-			w.lnPrint("switch p.Buffer[position] {")
-			element := list.Front()
-			for ; element != nil; element = element.Next() {
-				sequence := element.Value.(List).Front()
-				class := sequence.Value.(List).Front().Value.(Node).(Token).GetClass()
+			done.cJump(false, "(p.position < len(p.Buffer) || p.fail())")
+			stats.Switch++
+			caseBytes := 0
+			for _, x := range list.Items() {
+				caseBytes += x.(List).front().Value.(List).front().Value.(Node).(Token).GetClass().len()
+			}
+			table := caseBytes > maxCaseBytes && list.Len() < 256
+			if table {
+				w.lnPrint("switch yyDispatch[%d][p.Buffer[p.position]] {", t.dispatchTable(node))
+			} else {
+				w.lnPrint("switch p.Buffer[p.position] {")
+			}
+			element := list.front()
+			for i := 1; element != nil; element, i = element.Next(), i+1 {
+				sequence := element.Value.(List).front()
+				class := sequence.Value.(List).front().Value.(Node).(Token).GetClass()
 				node := sequence.Next().Value.(Node)
 
-				if element.Next() == nil {
+				if table {
+					w.lnPrint("case %d:", i)
+				} else if element.Next() == nil {
 					if class.len() > 2 {
 						w.lnPrint("default:")
 						w.indent++
+						if t.skipping[element.Value.(Node)] {
+							w.lnPrint("p.fail()")
+						}
 						updateFlags(compile(node, done))
 						w.indent--
 						break
 					}
 				}
 
-				w.lnPrint("case")
-				comma := false
-				for d := 0; d < 256; d++ {
-					if class.has(uint8(d)) {
-						if comma {
-							print(",")
-						}
-						s := ""
-						switch uint8(d) {
-						case '\a':
-							s = `\a` /* bel */
-						case '\b':
-							s = `\b` /* bs */
-						case '\f':
-							s = `\f` /* ff */
-						case '\n':
-							s = `\n` /* nl */
-						case '\r':
-							s = `\r` /* cr */
-						case '\t':
-							s = `\t` /* ht */
-						case '\v':
-							s = `\v` /* vt */
-						case '\\':
-							s = `\\` /* \ */
-						case '\'':
-							s = `\'` /* ' */
-						default:
-							switch {
-							case d >= 0 && d < 32 || d >= 0x80:
-								s = fmt.Sprintf("\\%03o", d)
+				if !table {
+					w.lnPrint("case")
+					comma := false
+					for d := 0; d < 256; d++ {
+						if class.has(uint8(d)) {
+							if comma {
+								print(",")
+							}
+							s := ""
+							switch uint8(d) {
+							case '\a':
+								s = `\a` /* bel */
+							case '\b':
+								s = `\b` /* bs */
+							case '\f':
+								s = `\f` /* ff */
+							case '\n':
+								s = `\n` /* nl */
+							case '\r':
+								s = `\r` /* cr */
+							case '\t':
+								s = `\t` /* ht */
+							case '\v':
+								s = `\v` /* vt */
+							case '\\':
+								s = `\\` /* \ */
+							case '\'':
+								s = `\'` /* ' */
 							default:
-								s = fmt.Sprintf("%c", d)
+								switch {
+								case d >= 0 && d < 32 || d >= 0x80:
+									s = fmt.Sprintf("\\%03o", d)
+								default:
+									s = fmt.Sprintf("%c", d)
+								}
 							}
+							print(" '%s'", s)
+							comma = true
 						}
-						print(" '%s'", s)
-						comma = true
 					}
+					print(":")
 				}
-				print(":")
 				w.indent++
+				if t.skipping[element.Value.(Node)] {
+					// the alternatives skipped would have failed here
+					w.lnPrint("p.fail()")
+				}
 				if O.unorderedFirstItem {
 					updateFlags(compileOptFirst(w, node, done, compile))
 				} else {
@@ -1214,6 +1616,7 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 				if element.Next() == nil {
 					w.lnPrint("default:")
 					w.indent++
+					w.lnPrint("p.fail()")
 					done.jump()
 					w.indent--
 				}
@@ -1226,14 +1629,14 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 		case TypeSequence:
 			var cs []string
 			var peek Type
-			var element0 = node.(List).Front()
+			var element0 = node.(List).front()
 
 			if O.seqPeekNot {
 				for el := element0; el != nil; el = el.Next() {
 					sub := el.Value.(Node)
 					switch typ := sub.GetType(); typ {
 					case TypePeekNot:
-						switch child := sub.(List).Front().Value.(Node); child.GetType() {
+						switch child := sub.(List).front().Value.(Node); child.GetType() {
 						case TypeCharacter:
 							cs = append(cs, "'"+child.String()+"'")
 							continue
@@ -1255,8 +1658,8 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 
 			if peek != 0 {
 				stats.seqIfNot++
-				ko.cJump(true, "position == len(p.Buffer)")
-				w.lnPrint("switch p.Buffer[position] {")
+				ko.cJump(true, "p.position == len(p.Buffer)")
+				w.lnPrint("switch p.Buffer[p.position] {")
 
 				w.lnPrint("case %s:", strings.Join(cs, ", "))
 				w.indent++
@@ -1265,11 +1668,27 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 				w.lnPrint("default:")
 				w.indent++
 				if peek == TypeDot {
-					w.lnPrint("position++")
+					w.lnPrint("p.position++")
 					chgok.pos = true
 				}
 			}
+			cuts := 0
 			for element := element0; element != nil; element = element.Next() {
+				if element.Value.(Node).GetType() == TypeCut {
+					if element.Next() == nil {
+						break
+					}
+					// Failures of the remaining elements are not
+					// backtracked from; p.Max is reset to find the
+					// farthest failure after the cut.
+					w.begin()
+					w.lnPrint("max0 := p.Max")
+					w.lnPrint("p.Max = p.position")
+					ko = w.newLabel("cut")
+					ko.cut = true
+					cuts++
+					continue
+				}
 				cko, cok := compile(element.Value.(Node), ko)
 				if element.Next() == nil {
 					if chgok.pos {
@@ -1281,12 +1700,18 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 				}
 				updateFlags(cko, cok)
 			}
+			for ; cuts > 0; cuts-- {
+				w.lnPrint("if p.Max < max0 {")
+				w.lnPrint("\tp.Max = max0")
+				w.lnPrint("}")
+				w.end()
+			}
 			if peek != 0 {
 				w.indent--
 				w.lnPrint("}")
 			}
 		case TypePeekFor:
-			sub := node.(List).Front().Value.(Node)
+			sub := node.(List).front().Value.(Node)
 			if canCompilePeek(sub, false, ko) {
 				return
 			}
@@ -1296,7 +1721,7 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			l.lrestore(nil, cok.pos, cok.thPos)
 			chgko = cko
 		case TypePeekNot:
-			sub := node.(List).Front().Value.(Node)
+			sub := node.(List).front().Value.(Node)
 			if canCompilePeek(sub, true, ko) {
 				return
 			}
@@ -1309,14 +1734,15 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			}
 			chgko = cok
 		case TypeQuery:
-			sub := node.(List).Front().Value.(Node)
-			switch sub.GetType() {
-			case TypeCharacter:
-				w.lnPrint("matchChar('%v')", sub)
+			sub := node.(List).front().Value.(Node)
+			switch _, counted := t.cover[sub]; {
+			case counted:
+			case sub.GetType() == TypeCharacter:
+				w.lnPrint("p.matchChar('%v')", sub)
 				chgok.pos = true
 				return
-			case TypeDot:
-				w.lnPrint("matchDot()")
+			case sub.GetType() == TypeDot:
+				w.lnPrint("p.matchDot()")
 				chgok.pos = true
 				return
 			}
@@ -1339,17 +1765,17 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			out := w.newLabel("out")
 			again.label()
 			out.saveBlock()
-			cko, cok := compile(node.(List).Front().Value.(Node), out)
+			cko, cok := compile(node.(List).front().Value.(Node), out)
 			again.jump()
 			out.restore(cko.pos, cko.thPos)
 			chgok = cok
 		case TypePlus:
 			again := w.newLabel("loop")
 			out := w.newLabel("out")
-			updateFlags(compile(node.(List).Front().Value.(Node), ko))
+			updateFlags(compile(node.(List).front().Value.(Node), ko))
 			again.label()
 			out.saveBlock()
-			cko, _ := compile(node.(List).Front().Value.(Node), out)
+			cko, _ := compile(node.(List).front().Value.(Node), out)
 			again.jump()
 			if out.used {
 				out.restore(cko.pos, cko.thPos)
@@ -1365,7 +1791,7 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 	// figure out which items need to restore position resp. thunkPosition,
 	// storing into w.saveFlags
 	w.setDry(true)
-	for element := t.Front(); element != nil; element = element.Next() {
+	for element := t.ruleList.Front(); element != nil; element = element.Next() {
 		node := element.Value.(Node)
 		if node.GetType() != TypeRule {
 			continue
@@ -1391,21 +1817,199 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 	if Verbose {
 		log.Printf("%+v\n", stats)
 	}
+	t.writeParser(w, nil)
+
+	/* now for the real compile pass */
+	parser := t.defines["Peg"]
+	if O.methods {
+		// The table of rules refers to the methods emitted below.
+		first := true
+		for element := t.ruleList.Front(); element != nil; element = element.Next() {
+			node := element.Value.(Node)
+			if node.GetType() != TypeRule {
+				continue
+			}
+			rule := node.(*rule)
+			if rule.GetExpression() == nilNode {
+				w.lnPrint("nil,")
+				continue
+			}
+			if count, ok := t.rulesCount[rule.String()]; ok && t.inline && count == 1 && !first {
+				w.lnPrint("nil,")
+			} else {
+				w.lnPrint("(*%s).rule%s,", parser, rule.GoString())
+			}
+			first = false
+		}
+		print("\n\t}")
+		print("\n}\n")
+		w.indent = 0
+	}
+
+	// The bodies of the rules are compiled before they are written,
+	// so that rules with identical bodies may share a method.
+	var rules []*rule
+	bodies := make(map[*rule]string)
+	for element := t.ruleList.Front(); element != nil; element = element.Next() {
+		node := element.Value.(Node)
+		if node.GetType() != TypeRule {
+			continue
+		}
+		rule := node.(*rule)
+		if rule.GetExpression() == nilNode {
+			continue
+		}
+		rules = append(rules, rule)
+		w.setLabelBase()
+		ko := w.newLabel("ko")
+		if count, ok := t.rulesCount[rule.String()]; ok && t.inline && count == 1 && ko.id != 0 {
+			continue
+		}
+		var body strings.Builder
+		w.Writer = &body
+		w.indent++
+		ko.save()
+		cko, _ := compileExpression(rule, ko)
+		w.lnPrint("match = true")
+		w.lnPrint("return")
+		if ko.used {
+			ko.restore(cko.pos, cko.thPos)
+			w.lnPrint("return")
+		}
+		w.indent--
+		bodies[rule] = body.String()
+	}
+	w.Writer = out
+	shared := make(map[string]int)
+	if O.size {
+		shared = sharedBodies(rules, bodies, &size)
+	}
+
+	for element := t.ruleList.Front(); element != nil; element = element.Next() {
+		node := element.Value.(Node)
+		if node.GetType() != TypeRule {
+			continue
+		}
+		rule := node.(*rule)
+		expression := rule.GetExpression()
+		if expression == nilNode {
+			t.warnf("rule '%v' used but not defined", rule)
+			if !O.methods {
+				w.lnPrint("nil,")
+			}
+			continue
+		}
+		if O.methods {
+			print("\n")
+		}
+		w.lnPrint("/* %v ", rule.GetId())
+		printRule(rule)
+		print(" */")
+		if _, ok := t.rulesCount[rule.String()]; !ok {
+			t.warnf("rule '%v' defined but not used", rule)
+		}
+		body, ok := bodies[rule]
+		if !ok {
+			if !O.methods {
+				w.lnPrint("nil,")
+			}
+			continue
+		}
+		if O.methods {
+			w.lnPrint("func (p *%s) rule%s() (match bool) {", parser, rule.GoString())
+		} else {
+			w.lnPrint("func(p *%s) (match bool) {", parser)
+		}
+		w.indent++
+		if !rule.helper {
+			w.lnPrint("if p.trace != nil {")
+			w.lnPrint("\tp.trace.enter(p.Max, rule%s)", rule.GoString())
+			w.lnPrint("\tdefer func() { p.trace.leave(p.Max) }()")
+			w.lnPrint("}")
+		}
+		if id, ok := shared[body]; ok {
+			w.lnPrint("return p.yyBody%d()", id)
+		} else {
+			print("%s", body)
+		}
+		w.indent--
+		if O.methods {
+			w.lnPrint("}")
+		} else {
+			w.lnPrint("},")
+		}
+	}
+	if O.methods {
+		print("\n")
+	} else {
+		print("\n\t}")
+		print("\n}\n")
+	}
+
+	// The methods shared by rules with identical bodies are written in
+	// the order of the first rule using them. Unless rules are methods,
+	// their bodies have been indented as elements of yyRules.
+	written := make(map[string]bool)
+	for _, rule := range rules {
+		body, ok := bodies[rule]
+		if id, isShared := shared[body]; ok && isShared && !written[body] {
+			written[body] = true
+			if w.indent > 0 {
+				body = strings.Replace(body, "\n"+strings.Repeat("\t", w.indent), "\n", -1)
+			}
+			print("\nfunc (p *%s) yyBody%d() (match bool) {%s\n}\n", parser, id, body)
+		}
+	}
+	if !w.dryRun {
+		t.writeTries(w)
+	}
+	for _, s := range t.trailers {
+		print("%s", s)
+	}
+	if O.size && Verbose {
+		log.Printf("size: %d helper rules, %d rules sharing bodies, %d class tables shared; %d bytes saved\n",
+			size.helpers, size.bodies, size.classes, unshared-int(generated))
+	}
+	return nil
+}
+
+// writeParser writes the part of a parser that does not depend on
+// the grammar's rules. For the machine backend, vm is the program
+// the grammar has been compiled into, otherwise it is nil.
+func (t *Tree) writeParser(out io.Writer, vm *vmProgram) {
 	tpl := template.New("parser")
 	tpl.Funcs(template.FuncMap{
-		"len": itemLength,
-		"def": func(key string) string { return t.defines[key] },
+		"len":    itemLength,
+		"vm":     func() *vmProgram { return vm },
+		"def":    func(key string) string { return t.defines[key] },
+		"buffer": t.textType,
+		"header": func() string { return t.header(vm != nil) },
 		"id": func(identifier string) string {
 			if t.defines["noexport"] != "" {
 				return identifier
 			}
 			return strings.Title(identifier)
 		},
-		"stats":    func() *statValues { return &stats },
-		"nvar":     func() int { return nvar },
+		"stats":          func() *statValues { return &stats },
+		"valueTypes":     func() []string { return t.valueTypes },
+		"numCoverPoints": func() int { return len(t.cover) },
+		"cuts":           t.hasCuts,
+		"classes":        t.classes,
+		"dispatchTables": func() (tables []string) {
+			for _, table := range t.dispatchTables {
+				tables = append(tables, quoteTable(table))
+			}
+			return
+		},
+		"keywords": func() (sets [][]string) {
+			for _, set := range t.keywords {
+				sets = append(sets, set.sorted())
+			}
+			return
+		},
 		"numRules": func() int { return len(t.rules) },
 		"sortedRules": func() (r []*rule) {
-			for el := t.Front(); el != nil; el = el.Next() {
+			for el := t.ruleList.Front(); el != nil; el = el.Next() {
 				node := el.Value.(Node)
 				if node.GetType() != TypeRule {
 					continue
@@ -1414,9 +2018,9 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			}
 			return
 		},
-		"hasCommit": func() bool { return counts[TypeCommit] > 0 },
+		"numActions": func() int { return len(t.Actions) + 3*len(t.valueTypes) },
 		"actionBits": func() (bits int) {
-			for n := len(t.Actions); n != 0; n >>= 1 {
+			for n := len(t.Actions) + 3*len(t.valueTypes); n != 0; n >>= 1 {
 				bits++
 			}
 			switch {
@@ -1435,52 +2039,263 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 	if _, err := tpl.Parse(parserTemplate); err != nil {
 		log.Fatal(err)
 	}
-	if err := tpl.Execute(w, t); err != nil {
+	if err := tpl.Execute(out, t); err != nil {
 		log.Fatal(err)
 	}
+}
 
-	/* now for the real compile pass */
-	for element := t.Front(); element != nil; element = element.Next() {
-		node := element.Value.(Node)
-		if node.GetType() != TypeRule {
-			continue
+// textType returns the Go type of the buffer, and of yytext.
+func (t *Tree) textType() string {
+	if t.defines["bytes"] != "" {
+		return "[]byte"
+	}
+	return "string"
+}
+
+// packageClause matches the package clause within the headers.
+var packageClause = regexp.MustCompile(`(?m)^package[ \t]+\w+[^\n]*`)
+
+// header returns the headers of the grammar, followed by the package
+// clause if the package has been defined, and the imports needed by
+// the generated code. Imports that are missing from the headers are
+// inserted right after their package clause.
+func (t *Tree) header(vm bool) string {
+	text := strings.Join(t.Headers, "")
+	var std, other []string
+	paths := []string{"fmt", "io", "sync", "unicode/utf8"}
+	if !vm && t.defines["cover"] != "" {
+		paths = []string{"fmt", "io", "sync", "sync/atomic", "unicode/utf8"}
+	}
+	for _, path := range paths {
+		if !strings.Contains(text, strconv.Quote(path)) {
+			std = append(std, path)
 		}
-		rule := node.(*rule)
-		expression := rule.GetExpression()
-		if expression == nilNode {
-			fmt.Fprintf(os.Stderr, "rule '%v' used but not defined\n", rule)
-			w.lnPrint("nil,")
-			continue
+	}
+	if (vm || t.usesPeg()) && !strings.Contains(text, `"github.com/knieriem/peg"`) {
+		other = append(other, "github.com/knieriem/peg")
+	}
+	var decl string
+	switch n := len(std) + len(other); {
+	case n == 1:
+		decl = "\nimport " + strconv.Quote(append(std, other...)[0]) + "\n"
+	case n > 1:
+		decl = "\nimport (\n"
+		for _, path := range std {
+			decl += "\t" + strconv.Quote(path) + "\n"
 		}
-		w.setLabelBase()
-		ko := w.newLabel("ko")
-		w.lnPrint("/* %v ", rule.GetId())
-		printRule(rule)
-		print(" */")
-		if count, ok := t.rulesCount[rule.String()]; !ok {
-			fmt.Fprintf(os.Stderr, "rule '%v' defined but not used\n", rule)
-		} else if t.inline && count == 1 && ko.id != 0 {
-			w.lnPrint("nil,")
+		if len(std) != 0 && len(other) != 0 {
+			decl += "\n"
+		}
+		for _, path := range other {
+			decl += "\t" + strconv.Quote(path) + "\n"
+		}
+		decl += ")\n"
+	}
+	if pkg := t.defines["package"]; pkg != "" {
+		return text + "package " + pkg + "\n" + decl
+	}
+	if loc := packageClause.FindStringIndex(text); loc != nil {
+		return text[:loc[1]] + "\n" + strings.TrimSuffix(decl, "\n") + text[loc[1]:]
+	}
+	return text + decl
+}
+
+// pegIdent matches a qualified identifier of package peg.
+var pegIdent = regexp.MustCompile(`\bpeg\.[A-Z]`)
+
+// usesPeg reports whether the user state, the types of semantic
+// values, the actions, or the trailers refer to package peg.
+func (t *Tree) usesPeg() bool {
+	texts := append([]string{t.defines["userstate"], t.defines["yystype"]}, t.trailers...)
+	texts = append(texts, t.valueTypes...)
+	for _, a := range t.Actions {
+		texts = append(texts, a.text)
+	}
+	for _, text := range texts {
+		if pegIdent.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// setValueTypes assigns an index to each Go type of semantic values
+// used within the grammar, i.e. of variables, and of rules
+// storing their result into `$$'. Each variable gets the type of the
+// rule it is bound to. Variables are given offsets into a frame, that
+// is allocated per rule and type on a separate value stack.
+// A variable bound to rules of different types is an error,
+// which is recorded in t.err.
+func (t *Tree) setValueTypes() {
+	index := make(map[string]int)
+	typeIndex := func(typ string) int {
+		if typ == "" {
+			typ = t.defines["yystype"]
+		}
+		k, ok := index[typ]
+		if !ok {
+			k = len(t.valueTypes)
+			index[typ] = k
+			t.valueTypes = append(t.valueTypes, typ)
+		}
+		return k
+	}
+	t.valueTypes = nil
+	for element := t.ruleList.Front(); element != nil; element = element.Next() {
+		r := element.Value.(*rule)
+		r.vtype = -1
+		for _, v := range r.variables {
+			v.vtype = -1
+			if v.capture {
+				v.vtype = typeIndex(t.textType())
+			}
+		}
+	}
+	for element := t.ruleList.Front(); element != nil; element = element.Next() {
+		r := element.Value.(*rule)
+		Walk(r.GetExpression(), func(node Node) {
+			switch node.GetType() {
+			case TypeName:
+				v := node.(*name).varp
+				if v == nil {
+					break
+				}
+				k := typeIndex(t.rules[node.String()].typ)
+				if v.vtype == -1 {
+					v.vtype = k
+				} else if v.vtype != k && t.err == nil {
+					t.err = fmt.Errorf("peg: rule '%v': variable '%s' bound to values of types %s and %s",
+						r, v.name, t.valueTypes[v.vtype], t.valueTypes[k])
+				}
+			case TypeAction:
+				if strings.Contains(node.String(), "$$") {
+					r.vtype = typeIndex(r.typ)
+				}
+			}
+		})
+	}
+	for element := t.ruleList.Front(); element != nil; element = element.Next() {
+		r := element.Value.(*rule)
+		r.frame = nil
+		if len(r.variables) == 0 {
 			continue
 		}
-		w.lnPrint("func() (match bool) {")
-		w.indent++
-		ko.save()
-		cko, _ := compileExpression(rule, ko)
-		w.lnPrint("match = true")
-		w.lnPrint("return")
-		if ko.used {
-			ko.restore(cko.pos, cko.thPos)
-			w.lnPrint("return")
+		r.frame = make([]int, len(t.valueTypes))
+		for _, v := range r.variables {
+			if v.vtype == -1 {
+				v.vtype = typeIndex("")
+				for len(r.frame) < len(t.valueTypes) {
+					r.frame = append(r.frame, 0)
+				}
+			}
+			r.frame[v.vtype]++
+			v.offset = -r.frame[v.vtype]
 		}
-		w.indent--
-		w.lnPrint("},")
 	}
-	print("\n\t}")
-	print("\n}\n")
+}
 
-	for _, s := range t.trailers {
-		print("%s", s)
+// Walk calls fn for node, and, recursively, for each of its
+// sub-expressions. Rules referenced by name are not entered.
+func Walk(node Node, fn func(Node)) {
+	fn(node)
+	switch node.GetType() {
+	case TypeRule:
+		Walk(node.(Rule).GetExpression(), fn)
+	case TypeAlternate, TypeUnorderedAlternate, TypeSequence,
+		TypePeekFor, TypePeekNot, TypeQuery, TypeStar, TypePlus:
+		for element := node.(List).front(); element != nil; element = element.Next() {
+			Walk(element.Value.(Node), fn)
+		}
+	}
+}
+
+// Format returns node in the notation used by the comments of
+// generated parsers, e.g. `Sum <- (Product ('+' Product)*)'.
+func Format(node Node) string {
+	var b strings.Builder
+	writeNode(&b, node)
+	return b.String()
+}
+
+func writeNode(w io.Writer, node Node) {
+	switch node.GetType() {
+	case TypeRule:
+		fmt.Fprintf(w, "%v <- ", node)
+		expression := node.(Rule).GetExpression()
+		if expression != nilNode {
+			writeNode(w, expression)
+		}
+	case TypeDot:
+		fmt.Fprintf(w, ".")
+	case TypeName:
+		fmt.Fprintf(w, "%v", node)
+	case TypeCharacter,
+		TypeString:
+		fmt.Fprintf(w, "'%v'", node)
+	case TypeKeyword:
+		fmt.Fprintf(w, "`%v`", node)
+	case TypeIdent:
+		fmt.Fprintf(w, "(%v - keywords)", node)
+	case TypeClass:
+		fmt.Fprintf(w, "[%v]", node)
+	case TypePredicate:
+		fmt.Fprintf(w, "&{%v}", node)
+	case TypeAction:
+		fmt.Fprintf(w, "{%v}", node)
+	case TypeCommit:
+		fmt.Fprintf(w, "commit")
+	case TypeCut:
+		fmt.Fprintf(w, "~")
+	case TypeBegin:
+		fmt.Fprintf(w, "<")
+	case TypeEnd:
+		fmt.Fprintf(w, ">")
+	case TypeAlternate:
+		fmt.Fprintf(w, "(")
+		list := node.(List)
+		element := list.front()
+		writeNode(w, element.Value.(Node))
+		for element = element.Next(); element != nil; element = element.Next() {
+			fmt.Fprintf(w, " / ")
+			writeNode(w, element.Value.(Node))
+		}
+		fmt.Fprintf(w, ")")
+	case TypeUnorderedAlternate:
+		fmt.Fprintf(w, "(")
+		element := node.(List).front()
+		writeNode(w, element.Value.(Node))
+		for element = element.Next(); element != nil; element = element.Next() {
+			fmt.Fprintf(w, " | ")
+			writeNode(w, element.Value.(Node))
+		}
+		fmt.Fprintf(w, ")")
+	case TypeSequence:
+		fmt.Fprintf(w, "(")
+		element := node.(List).front()
+		writeNode(w, element.Value.(Node))
+		for element = element.Next(); element != nil; element = element.Next() {
+			fmt.Fprintf(w, " ")
+			writeNode(w, element.Value.(Node))
+		}
+		fmt.Fprintf(w, ")")
+	case TypePeekFor:
+		fmt.Fprintf(w, "&")
+		writeNode(w, node.(List).front().Value.(Node))
+	case TypePeekNot:
+		fmt.Fprintf(w, "!")
+		writeNode(w, node.(List).front().Value.(Node))
+	case TypeQuery:
+		writeNode(w, node.(List).front().Value.(Node))
+		fmt.Fprintf(w, "?")
+	case TypeStar:
+		writeNode(w, node.(List).front().Value.(Node))
+		fmt.Fprintf(w, "*")
+	case TypePlus:
+		writeNode(w, node.(List).front().Value.(Node))
+		fmt.Fprintf(w, "+")
+	case TypeNil:
+	default:
+		fmt.Fprintf(os.Stderr, "illegal node type: %v\n", node.GetType())
 	}
 }
 
@@ -1491,32 +2306,32 @@ func compileOptFirst(w *writer, node Node, ko *label, compile func(Node, *label)
 	}
 	switch node.GetType() {
 	case TypeCharacter:
-		w.lnPrint("position++ // matchChar")
+		w.lnPrint("p.position++ // matchChar")
 		chgok.pos = true
 		stats.optFirst.char++
 	case TypeDot:
 		chgok.pos = true
 		stats.optFirst.dot++
 	case TypeClass:
-		w.lnPrint("position++ // matchClass")
+		w.lnPrint("p.position++ // matchClass")
 		chgok.pos = true
 		stats.optFirst.class++
 	case TypeString:
-		if s := node.String(); len(s) == 2 {
-			w.lnPrint("position++ // matchString(`%s`)", s)
-			ko.cJump(false, "matchChar('%c')", s[1])
+		if s := unescape(node.String()); len(s) == 2 {
+			w.lnPrint("p.position++ // matchString(`%s`)", node)
+			ko.cJump(false, "p.matchChar(%s)", byteLit(s[1]))
 			chgok.pos = true
 			stats.Match.Char++
 			stats.optFirst.str++
 		} else if s != "" {
-			w.lnPrint("position++")
-			ko.cJump(false, "matchString(\"%s\")", s[1:])
+			w.lnPrint("p.position++")
+			ko.cJump(false, "p.matchString(%q)", s[1:])
 			chgok.pos = true
 			stats.Match.String++
 			stats.optFirst.str++
 		}
 	case TypeSequence:
-		front := node.(List).Front()
+		front := node.(List).front()
 		for element := front; element != nil; element = element.Next() {
 			if element == front {
 				updateFlags(compileOptFirst(w, element.Value.(Node), ko, compile))
@@ -1613,6 +2428,7 @@ type label struct {
 	used           bool
 	saved          bool
 	savedBlockOpen bool
+	cut            bool // failing after a cut: jumps abort the parse
 }
 
 func (w *writer) newLabel(name string) (l *label) {
@@ -1648,6 +2464,10 @@ func (w *label) label() {
 }
 
 func (w *label) jump() {
+	if w.cut {
+		w.lnPrint("p.cutFail()")
+		return
+	}
 	if !w.saved && w.sid == 0 {
 		w.lnPrint("return")
 		return
@@ -1669,11 +2489,11 @@ func (w *label) save() {
 	w.nSaveSections++
 	switch {
 	case save.pos && save.thPos:
-		w.lnPrint("position%d, thunkPosition%d := position, thunkPosition", w.sid, w.sid)
+		w.lnPrint("position%d, thunkPosition%d := p.position, p.thunkPosition", w.sid, w.sid)
 	case !save.pos && save.thPos:
-		w.lnPrint("thunkPosition%d := thunkPosition", w.sid)
+		w.lnPrint("thunkPosition%d := p.thunkPosition", w.sid)
 	case save.pos:
-		w.lnPrint("position%d := position", w.sid)
+		w.lnPrint("position%d := p.position", w.sid)
 	default:
 		return
 	}
@@ -1700,12 +2520,12 @@ func (w *label) lrestore(label *label, savePos, saveThPos bool) {
 	}
 	switch {
 	case savePos && saveThPos:
-		w.lnPrint("position, thunkPosition = position%d, thunkPosition%d", w.sid, w.sid)
+		w.lnPrint("p.position, p.thunkPosition = position%d, thunkPosition%d", w.sid, w.sid)
 	case !savePos && saveThPos:
-		w.lnPrint("thunkPosition = thunkPosition%d", w.sid)
+		w.lnPrint("p.thunkPosition = thunkPosition%d", w.sid)
 		stats.elimRestore.pos++
 	case savePos:
-		w.lnPrint("position = position%d", w.sid)
+		w.lnPrint("p.position = position%d", w.sid)
 		stats.elimRestore.thunkPos++
 	default:
 		stats.elimRestore.thunkPos++
@@ -1738,7 +2558,9 @@ func (w *label) cJump(jumpIfTrue bool, format string, a ...interface{}) {
 	}
 	w.lnPrint(format, a...)
 	fmt.Fprint(w, " {")
-	if !w.saved && w.sid == 0 {
+	if w.cut {
+		w.lnPrint("\tp.cutFail()")
+	} else if !w.saved && w.sid == 0 {
 		w.lnPrint("\treturn")
 	} else {
 		w.lnPrint("\tgoto %v", w)
@@ -1769,6 +2591,7 @@ type statValues struct {
 	optFirst struct {
 		char, dot, str, class int
 	}
+	Switch      int // the number of switch statements on the next byte
 	seqIfNot    int
 	inlineLeafs int
 }
@@ -0,0 +1,1223 @@
+package peg
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A backend describes how the parsers that are compared
+// with the parsing machine are generated.
+type backend struct {
+	name            string
+	inline, _switch bool
+	flags           string // optimization flags of Compile
+	allRules        bool   // parse errors list every active rule
+	bytes           bool   // the buffer is a []byte
+}
+
+var backends = []backend{
+	{name: "plain", allRules: true},
+	{name: "inline", inline: true},
+	{name: "switch all", inline: true, _switch: true, flags: "all"},
+	{name: "all:m", inline: true, _switch: true, flags: "all:m"},
+	{name: "all:z", inline: true, _switch: true, flags: "all:z"},
+}
+
+// A parseCase is an input, and the result expected from applying
+// a rule to it: "ok" and the end of the match, or the message of
+// the parse error, and the rules active at the failure.
+type parseCase struct {
+	input, want string
+}
+
+// A parseTest applies a rule of a grammar to several inputs.
+type parseTest struct {
+	name    string
+	grammar string
+	rule    string
+	budget  int // of generated parsers, see setBudget
+	cases   []parseCase
+	outputs []string // if set, printed by the actions of generated parsers, for each case
+}
+
+// vmResults applies the rule of test to each input, using the
+// parsing machine, and formats the results like mainProgram.
+func vmResults(t *testing.T, test parseTest) (results []string) {
+	g, err := Load(test.grammar)
+	if err != nil {
+		t.Fatalf("%s: %v", test.name, err)
+	}
+	for _, c := range test.cases {
+		tree, err := g.Parse(c.input, test.rule)
+		switch e := err.(type) {
+		case nil:
+			results = append(results, fmt.Sprintf("ok %d", tree.End))
+		case *ParseError:
+			results = append(results, fmt.Sprintf("%v [%s]", e, strings.Join(e.Rules, " ")))
+		default:
+			t.Fatalf("%s: %v", test.name, err)
+		}
+	}
+	return
+}
+
+// mainProgram applies a rule of the generated parser to each input.
+// A parse that exhausts a positive budget yields "budget exhausted".
+const mainProgram = `package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func main() {
+	for _, s := range $INPUTS {
+		p := &$PARSER{Buffer: $CONVERSION(s)}
+		p.Init()
+		if budget := $BUDGET; budget > 0 {
+			p.setBudget(budget)
+		}
+		fmt.Println(parse(p))
+		p.Release()
+	}
+}
+
+func parse(p *$PARSER) (result string) {
+	defer func() {
+		if e := recover(); e != nil {
+			result = "budget exhausted"
+		}
+	}()
+	switch e := p.Parse(rule$RULE).(type) {
+	case nil:
+		return fmt.Sprintf("ok %d", p.position)
+	case *ParseError:
+		return fmt.Sprintf("%v [%s]", e, strings.Join(e.Rules, " "))
+	default:
+		return e.Error()
+	}
+}
+`
+
+// goTool returns the path of the go command, or skips the test.
+func goTool(t *testing.T) string {
+	path := filepath.Join(runtime.GOROOT(), "bin", "go")
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	path, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	return path
+}
+
+// goResults generates a parser from the grammar of test, as configured
+// by b, and runs it on the inputs, formatting the results like
+// vmResults.
+func goResults(t *testing.T, test parseTest, b backend) []string {
+	tree, err := LoadTree(test.grammar)
+	if err != nil {
+		t.Fatalf("%s: %v", test.name, err)
+	}
+	if tree.defines["package"] == "" && !packageClause.MatchString(strings.Join(tree.Headers, "")) {
+		tree.Define("package", "main")
+	}
+	tree.inline, tree._switch = b.inline, b._switch
+	conversion := ""
+	if b.bytes {
+		tree.Define("bytes", "1")
+		conversion = "[]byte"
+	}
+	var warnings []string
+	tree.warnings = &warnings
+	var parser bytes.Buffer
+	tree.Compile(&parser, b.flags)
+
+	var inputs []string
+	for _, c := range test.cases {
+		inputs = append(inputs, c.input)
+	}
+	main := strings.NewReplacer(
+		"$INPUTS", fmt.Sprintf("%#v", inputs),
+		"$PARSER", tree.defines["Peg"],
+		"$CONVERSION", conversion,
+		"$BUDGET", fmt.Sprint(test.budget),
+		"$RULE", tree.rules[test.rule].GoString(),
+	).Replace(mainProgram)
+	return goRun(t, test.name+", "+b.name, parser.String(), main)
+}
+
+// goRun runs a generated parser together with a main program,
+// and returns the lines of its output.
+func goRun(t *testing.T, name, parser, main string) []string {
+	dir := t.TempDir()
+	for file, text := range map[string]string{"parser.go": parser, "main.go": main} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(goTool(t), "run", "parser.go", "main.go")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v\n%s", name, err, out)
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+}
+
+// withoutRules removes the rules from the message of a parse error.
+func withoutRules(result string) string {
+	if i := strings.LastIndex(result, " ["); i != -1 && strings.HasSuffix(result, "]") {
+		return result[:i]
+	}
+	return result
+}
+
+// runParseTests checks that the parsing machine, and the parsers
+// generated by backends, return the expected results.
+func runParseTests(t *testing.T, tests []parseTest, backends []backend) {
+	for _, test := range tests {
+		for i, got := range vmResults(t, test) {
+			if c := test.cases[i]; got != c.want {
+				t.Errorf("%s, machine: %q: got %q, want %q", test.name, c.input, got, c.want)
+			}
+		}
+		for _, b := range backends {
+			results := goResults(t, test, b)
+			if len(results) != len(test.cases) {
+				t.Errorf("%s, %s: got %d results, want %d:\n%s", test.name, b.name,
+					len(results), len(test.cases), strings.Join(results, "\n"))
+				continue
+			}
+			for i, got := range results {
+				c := test.cases[i]
+				want := c.want
+				if test.outputs != nil {
+					want = test.outputs[i] + want
+				}
+				if !b.allRules {
+					got, want = withoutRules(got), withoutRules(want)
+				}
+				if got != want {
+					t.Errorf("%s, %s: %q: got %q, want %q", test.name, b.name, c.input, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestMachine(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name: "arithmetic",
+			grammar: `
+Expr	= Sum !.
+Sum	= Product ( [-+] Product )*
+Product	= Value ( [/*] Value )*
+Value	= [0-9]+ | '(' Sum ')'
+`,
+			rule: "Expr",
+			cases: []parseCase{
+				{"1+2*3", "ok 5"},
+				{"(1+2)*34", "ok 8"},
+				{"1+", "1:3: unexpected end of file [Expr Sum Product Value]"},
+				{"1+2)", "1:4: unexpected character ')' [Expr Sum Product Value]"},
+				{"(1+2", "1:5: unexpected end of file [Expr Sum Product Value Sum Product Value]"},
+			},
+		},
+		{
+			name: "predicates",
+			grammar: `
+S	= A | B
+A	= "ab" 'c'? &'d' .
+B	= !'a' [^x]* 'x' .?
+`,
+			rule: "S",
+			cases: []parseCase{
+				{"abd", "ok 3"},
+				{"abcd", "ok 4"},
+				{"abce", "1:4: unexpected character 'e' [S A]"},
+				{"bbbx", "ok 4"},
+				{"bbxy", "ok 4"},
+				{"ax", "1:1: unexpected character 'a' [S A]"},
+			},
+		},
+	}, backends)
+}
+
+func TestCompileVM(t *testing.T) {
+	for _, test := range []struct {
+		define, err string
+	}{
+		{"bytes", "peg: []byte input is not supported by the parsing machine"},
+		{"cover", "peg: coverage mode is not supported by the parsing machine"},
+	} {
+		tree, err := LoadTree("S = 'a'\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.Define(test.define, "1")
+		var b bytes.Buffer
+		if err := tree.CompileVM(&b); err == nil || err.Error() != test.err || b.Len() != 0 {
+			t.Errorf("%s: got error %v, and %d bytes, want %q", test.define, err, b.Len(), test.err)
+		}
+	}
+}
+
+func TestValueTypes(t *testing.T) {
+	test := parseTest{
+		name: "value types",
+		grammar: `%{
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strconv"
+)
+%}
+
+%YYSTYPE string
+
+Expr:ast.Expr	= s:Sum !.		{ $$ = s; fmt.Println(types.ExprString(s)) }
+Sum:ast.Expr	= l:Product
+		( o:Op r:Product	{ l = &ast.BinaryExpr{X: l, Op: o, Y: r} }
+		)*			{ $$ = l }
+Product:ast.Expr = l:Value
+		( '*' r:Value		{ l = &ast.BinaryExpr{X: l, Op: token.MUL, Y: r} }
+		)*			{ $$ = l }
+Op:token.Token	= '+'			{ $$ = token.ADD }
+		| '-'			{ $$ = token.SUB }
+Value:ast.Expr	= n:Num			{ $$ = &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(n)} }
+		| i:Ident		{ $$ = ast.NewIdent(i) }
+		| '(' s:Sum ')'		{ $$ = &ast.ParenExpr{X: s} }
+Num:int		= < [0-9]+ >		{ $$, _ = strconv.Atoi(yytext) }
+Ident		= < [a-z]+ >		{ $$ = yytext }
+`,
+		rule: "Expr",
+		cases: []parseCase{
+			{input: "1+2*x"},
+			{input: "(a-07)*3"},
+			{input: "1+"},
+		},
+	}
+	// Each successful parse prints the expression built by the
+	// actions before its result.
+	want := []string{
+		"1 + 2 * x", "ok 5",
+		"(a - 7) * 3", "ok 8",
+		"1:3: unexpected end of file",
+	}
+	for _, b := range backends {
+		got := goResults(t, test, b)
+		for i := range got {
+			got[i] = withoutRules(got[i])
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got %q, want %q", b.name, got, want)
+		}
+	}
+
+	tree, err := LoadTree("S = v:Num ' ' v:Word { _ = v }\nNum:int = [0-9]+\nWord = [a-z]+\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	err = tree.Compile(&b, "")
+	if want := "peg: rule 'S': variable 'v' bound to values of types int and yyStype"; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+	if b.Len() != 0 {
+		t.Errorf("parser written despite the error:\n%s", &b)
+	}
+}
+
+func TestInlineValues(t *testing.T) {
+	// Pair and List, which are inlined, use the same variables; the
+	// values of the alternatives of Item that fail are discarded.
+	runParseTests(t, []parseTest{
+		{
+			name: "inlined values",
+			grammar: `%{
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+%}
+
+%YYSTYPE int
+
+S	= s:Items !.		{ fmt.Print(s, " ") }
+Items	= t:Zero ( i:Item	{ t += i } )* { $$ = t }
+Zero	= 			{ $$ = 0 }
+Item	= p:Pair ';'		{ $$ = p }
+	| '[' l:List ']' ';'	{ $$ = l }
+	| n:Num ';'		{ $$ = n }
+Pair	= a:Num ',' b:Num	{ $$ = a*10 + b }
+List	= a:Num ( ',' b:Num	{ a = a*2 + b } )* { $$ = a }
+Num	= d:Digit		{ $$ = d }
+	| 'v' n:Num		{ $$ = n + 5 }
+Digit	= < [0-9] >		{ $$, _ = strconv.Atoi(yytext) }
+`,
+			rule: "S",
+			cases: []parseCase{
+				{"1;2,3;", "ok 6"},
+				{"[1,2,3];v1;", "ok 11"},
+				{"v1,v2;[4];3;", "ok 12"},
+				{"1,2", "1:4: unexpected end of file [S Items Item]"},
+				{"[1,v];", "1:5: unexpected character ']' [S Items Item List Num Num Digit]"},
+			},
+			outputs: []string{"24 ", "17 ", "74 ", "", ""},
+		},
+	}, backends)
+}
+
+func TestBuilderErrors(t *testing.T) {
+	for _, test := range []struct {
+		calls func(t *Tree) error
+		err   string
+	}{
+		{func(t *Tree) error {
+			return t.AddExpression()
+		}, "peg: AddExpression: no rule, missing AddRule"},
+		{func(t *Tree) error {
+			t.AddRule("S")
+			return t.AddExpression()
+		}, "peg: AddExpression: no expression for rule 'S'"},
+		{func(t *Tree) error {
+			t.AddRule("S")
+			t.AddString("a")
+			t.AddString("b")
+			return t.AddExpression()
+		}, "peg: AddExpression: 2 expressions left for rule 'S', missing AddSequence or AddAlternate"},
+		{func(t *Tree) error {
+			t.AddRule("S")
+			return t.AddSequence()
+		}, "peg: AddSequence: need 2 expressions on the stack, found 0"},
+		{func(t *Tree) error {
+			t.AddRule("S")
+			t.AddString("a")
+			return t.AddAlternate()
+		}, "peg: AddAlternate: need 2 expressions on the stack, found 1"},
+		{func(t *Tree) error {
+			t.AddRule("S")
+			return t.AddStar()
+		}, "peg: AddStar: no expression on the stack"},
+		{func(t *Tree) error {
+			t.AddRule("S")
+			t.AddString("a")
+			t.AddExpression()
+			t.AddRule("T")
+			return t.AddPeekNot()
+		}, "peg: AddPeekNot: no expression on the stack"},
+	} {
+		err := test.calls(New(false, false))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("got error %v, want %q", err, test.err)
+		}
+	}
+
+	// The stack of the Tree grows with the nesting of expressions.
+	const depth = 1500
+	runParseTests(t, []parseTest{
+		{
+			name:    "nesting",
+			grammar: "S = " + strings.Repeat("'a' ( ", depth) + "'b'" + strings.Repeat(" )", depth) + " !.\n",
+			rule:    "S",
+			cases: []parseCase{
+				{strings.Repeat("a", depth) + "b", fmt.Sprint("ok ", depth+1)},
+				{strings.Repeat("a", depth) + "c", fmt.Sprintf("1:%d: unexpected character 'c' [S]", depth+1)},
+			},
+		},
+	}, backends)
+}
+
+func TestRelease(t *testing.T) {
+	const grammar = `%{
+package main
+
+import "fmt"
+%}
+
+%YYSTYPE int
+
+S	= n:Nest '.' commit ';'		{ fmt.Print(n, " ") }
+Nest	= '(' n:Nest ')'		{ $$ = n + 1 }
+	|				{ $$ = 0 }
+`
+	const main = `package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// values counts the values a stack refers to.
+func values(s *yyStack[int]) (n int) {
+	for _, v := range s.val {
+		if v != 0 {
+			n++
+		}
+	}
+	return
+}
+
+func main() {
+	deep := strings.Repeat("(", 300) + strings.Repeat(")", 300)
+	p := &yyParser{Buffer: deep + ".;"}
+	p.Init()
+	fmt.Println(p.Parse(ruleS), len(p.yy0.val) > 256)
+
+	// A parse failing after the commit leaves the frame of S on the stack.
+	p.ResetBuffer("(()).x")
+	fmt.Println(p.Parse(ruleS))
+	p.ResetBuffer("().;")
+	fmt.Println(p.yy0.p)
+	fmt.Println(p.Parse(ruleS))
+
+	p.ResetBuffer(deep + ".x")
+	p.Parse(ruleS)
+	s := p.yyState
+	p.Release()
+	fmt.Println(s.yy0.p, values(&s.yy0))
+
+	p.Buffer = "(()).;"
+	p.Init()
+	fmt.Println(p.yy0.p)
+	fmt.Println(p.Parse(ruleS))
+	p.Release()
+}
+`
+	const want = `300 <nil> true
+1:6: unexpected character 'x'
+0
+1 <nil>
+0 0
+0
+2 <nil>`
+	for _, b := range backends {
+		tree, err := LoadTree(grammar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.inline, tree._switch = b.inline, b._switch
+		var parser bytes.Buffer
+		if err := tree.Compile(&parser, b.flags); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(goRun(t, "release, "+b.name, parser.String(), main), "\n"); got != want {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", b.name, got, want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	for _, test := range []struct {
+		src, err string
+	}{
+		{"S = 'a' S?\n", ""},
+		{"package main\ntype yyParser Peg {}\nS <- 'a' S?\n", ""},
+		{"S = \"äö\" )\n", "1:10: unexpected character ')'"},
+		{"S = 'a'\nT = [a-\n", "3:1: unexpected end of file"},
+		{"S = T\n", "peg: rule 'T' used but not defined"},
+		{"S = &{ true } 'a'\n", "peg: rule 'S': semantic predicates are not supported"},
+		{"S = S 'a' | 'b'\n", "peg: possible infinite left recursion in rule 'S'"},
+		{"S = `return` 'a'\n", "peg: keyword 'return' not declared using %keywords"},
+		{"S = 'a' { if a { if b { c() } } }\n", ""},
+		{"S = 'a' { if a { b() }\n", "2:1: unexpected end of file"},
+	} {
+		_, err := Load(test.src)
+		switch {
+		case err == nil && test.err != "":
+			t.Errorf("%q: no error, want %q", test.src, test.err)
+		case err != nil && err.Error() != test.err:
+			t.Errorf("%q: got error %q, want %q", test.src, err, test.err)
+		}
+	}
+}
+
+func TestActionBraces(t *testing.T) {
+	tree, err := LoadTree("S = 'a' { for { if b { c() } } } 'b' {}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, a := range tree.Actions {
+		texts = append(texts, a.String())
+	}
+	if got, want := strings.Join(texts, "|"), " for { if b { c() } } |"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// treeString formats a parse tree like `S(A "a" B "b")'.
+func treeString(tree *ParseTree) string {
+	s := tree.Rule
+	if len(tree.Children) == 0 {
+		return s + " " + fmt.Sprintf("%q", tree.Text)
+	}
+	var children []string
+	for _, c := range tree.Children {
+		children = append(children, treeString(c))
+	}
+	return s + "(" + strings.Join(children, " ") + ")"
+}
+
+func TestParse(t *testing.T) {
+	g, err := Load(`
+List	= '[' - Item ( ',' - Item )* ']' -
+Item	= Word -
+Word	= [a-zäöü]+
+-	= [ \t\n]*
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		input, tree, err string
+		rules            []string
+	}{
+		{input: "[a]", tree: `List(- "" Item(Word "a" - "") - "")`},
+		{input: "[ab, cd]x", tree: `List(- "" Item(Word "ab" - "") - " " Item(Word "cd" - "") - "")`},
+		{input: "[äb,\n\t€d]", err: "2:2: unexpected character '€'", rules: []string{"List", "-"}},
+		{input: "[äb", err: "1:4: unexpected end of file", rules: []string{"List", "Item", "Word"}},
+	} {
+		tree, err := g.Parse(test.input, "List")
+		if err != nil {
+			e, ok := err.(*ParseError)
+			if !ok || e.Error() != test.err || strings.Join(e.Rules, " ") != strings.Join(test.rules, " ") {
+				t.Errorf("%q: got error %v %q, want %s %q", test.input, err, e.Rules, test.err, test.rules)
+			}
+			continue
+		}
+		if got := treeString(tree); got != test.tree || test.err != "" {
+			t.Errorf("%q: got %s, want %s", test.input, got, test.tree)
+		}
+	}
+	if _, err := g.Parse("[a]", "Missing"); err == nil {
+		t.Error("no error for a missing rule")
+	}
+}
+
+func TestRuneColumns(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name: "runes",
+			grammar: `
+Text	= Line ( '\n' Line )* !.
+Line	= ( [a-z] | "ä" | "€" | '\t' )*
+`,
+			rule: "Text",
+			cases: []parseCase{
+				{"aä€b\n\tä", "ok 11"},
+				{"ä€x!", "1:4: unexpected character '!' [Text Line]"},
+				{"a\n€€B", "2:3: unexpected character 'B' [Text Line]"},
+			},
+		},
+	}, backends)
+}
+
+func TestNamedCaptures(t *testing.T) {
+	// A capture starting with a variable binding is not named.
+	runParseTests(t, []parseTest{
+		{
+			name: "named captures",
+			grammar: `%{
+package main
+
+import "fmt"
+%}
+
+%YYSTYPE int
+
+S	= ( Bound | Named | Pair )+ !.
+Bound	= 'b' <v:Num '='>		{ fmt.Printf("%d %q, ", v, yytext) }
+Named	= 'n' <@v: Num '='>		{ fmt.Printf("%q, ", v) }
+Pair	= <@key: [a-z]+> ':' <@val: Num> { fmt.Printf("%s %s, ", key, val) }
+Num	= < [0-9]+ >			{ $$ = len(yytext) * 10 }
+`,
+			rule: "S",
+			cases: []parseCase{
+				{"b12=", "ok 4"},
+				{"n123=", "ok 5"},
+				{"b1=n2=x:34", "ok 10"},
+				{"b1", "1:3: unexpected end of file [S Bound Num]"},
+			},
+			outputs: []string{`20 "12=", `, `"123=", `, `10 "1=", "2=", x 34, `, ""},
+		},
+	}, backends)
+}
+
+func TestTextSpan(t *testing.T) {
+	// Positions of earlier offsets are looked up after those
+	// of later ones; offsets beyond the buffer yield its end.
+	runParseTests(t, []parseTest{
+		{
+			name: "text spans",
+			grammar: `%{
+package main
+
+import "fmt"
+%}
+
+S	= Item* !.		{ fmt.Printf("%v %v ", p.PositionOf(0), p.PositionOf(len(p.Buffer)+1)) }
+Item	= < Word >		{ b, e := p.TextSpan(); fmt.Printf("%s %v %v, ", yytext, b, e) }
+	| [ \t\r\n]
+Word	= ( [a-z] | "ä" | "€" )+
+`,
+			rule: "S",
+			cases: []parseCase{
+				{" ab\nä€c\r\n\tx", "ok 14"},
+				{"€\n\nä", "ok 7"},
+				{"ab\n€X", "2:2: unexpected character 'X' [S Item Word]"},
+			},
+			outputs: []string{
+				"ab {1 1 2} {3 1 4}, ä€c {4 2 1} {10 2 4}, x {13 3 2} {14 3 3}, {0 1 1} {14 3 3} ",
+				"€ {0 1 1} {3 1 2}, ä {5 3 1} {7 3 2}, {0 1 1} {7 3 2} ",
+				"",
+			},
+		},
+	}, append(backends, backend{name: "bytes", bytes: true, allRules: true}))
+}
+
+func TestErrorMessages(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name:    "unexpected characters",
+			grammar: "S = [a-z]* '.'\n",
+			rule:    "S",
+			cases: []parseCase{
+				{"ab.", "ok 3"},
+				{"ab\n.", `1:3: unexpected character '\n' [S]`},
+				{"a\tb", `1:2: unexpected character '\t' [S]`},
+				{"a€.", "1:2: unexpected character '€' [S]"},
+				{"ab\xff", "1:3: unexpected character '\ufffd' [S]"},
+				{"ab", "1:3: unexpected end of file [S]"},
+			},
+		},
+	}, append(backends, backend{name: "bytes", bytes: true, allRules: true}))
+}
+
+func TestBytes(t *testing.T) {
+	var bytesBackends []backend
+	for _, b := range backends {
+		b.name += " bytes"
+		b.bytes = true
+		bytesBackends = append(bytesBackends, b)
+	}
+	runParseTests(t, []parseTest{
+		{
+			name: "yytext of type []byte",
+			grammar: `%{
+package main
+
+import "fmt"
+%}
+
+S	= ( Word | Pair | ' ' )+ !.
+Word	= < [a-z]+ > !'='	{ fmt.Printf("%T:%s:%v ", yytext, yytext, &yytext[0] == &p.Buffer[p.textBegin]) }
+Pair	= <@k: [a-z]+> '=' <@v: [0-9]*> { fmt.Printf("%s=%q ", k, v) }
+`,
+			rule: "S",
+			cases: []parseCase{
+				{"ab cd=12 e=", "ok 11"},
+				{"x=1 yz", "ok 6"},
+				{"ab C", "1:4: unexpected character 'C' [S Word]"},
+			},
+			// yytext is a slice of the buffer, not a copy.
+			outputs: []string{`[]uint8:ab:true cd="12" e="" `, `x="1" []uint8:yz:true `, ""},
+		},
+	}, bytesBackends)
+}
+
+func TestExamples(t *testing.T) {
+	const grammar = `package main
+
+type yyParser Peg {}
+
+S <- 'a'+ !.
+%example "aa"
+%test S "aaa" ok
+%example "a"
+%test S "aa" ok
+%test S "b" fail
+`
+	tree, err := LoadTree(grammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(tree.Examples(), " "), "aa a"; got != want {
+		t.Errorf("examples: got %q, want %q", got, want)
+	}
+	var b bytes.Buffer
+	tree.CompileFuzz(&b)
+	i := strings.Index(b.String(), "[]string{")
+	j := strings.Index(b.String(), "} {")
+	if i == -1 || j < i {
+		t.Fatalf("no seeds found in\n%s", b.String())
+	}
+	if got, want := strings.Join(strings.Fields(b.String()[i:j]), " "), `[]string{ "aa", "a", "aaa", "b",`; got != want {
+		t.Errorf("seeds: got %s, want %s", got, want)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	const grammar = "S = A !.\nA = B+\nB = 'a'\n"
+	g, err := Load(grammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(budget int) (m Machine, exhausted bool) {
+		m.Budget = budget
+		defer func() { exhausted = recover() != nil }()
+		m.Run(&g.prog.Program, g.ruleIds["S"], "aaaaaaaa", nopHost{})
+		return
+	}
+	m, _ := run(1000)
+	steps := 1000 - m.Budget
+	for _, test := range []struct {
+		budget    int
+		exhausted bool
+	}{
+		{1, true},
+		{10, true},
+		{steps - 1, true},
+		{steps, false},
+		{steps + 1, false},
+		{0, false},
+	} {
+		if _, exhausted := run(test.budget); exhausted != test.exhausted {
+			t.Errorf("machine, budget %d of %d steps: got exhausted %v, want %v", test.budget, steps, exhausted, test.exhausted)
+		}
+	}
+
+	// Generated parsers count rule applications; inlined rules count,
+	// too: "aaaa" takes 2 for S and A, and 5 for B, which the budget
+	// allows exactly.
+	test := parseTest{
+		name:    "budget",
+		grammar: grammar,
+		rule:    "S",
+		budget:  7,
+		cases: []parseCase{
+			{"aaaa", "ok 4"},
+			{"aaaaa", "budget exhausted"},
+			{"aaa", "ok 3"},
+		},
+	}
+	for _, b := range backends[:2] {
+		for i, got := range goResults(t, test, b) {
+			if c := test.cases[i]; got != c.want {
+				t.Errorf("%s: %q: got %q, want %q", b.name, c.input, got, c.want)
+			}
+		}
+	}
+}
+
+func TestWriteSentences(t *testing.T) {
+	const grammar = `
+Expr	= Sum !.
+Sum	= Product ( [-+] Product )*
+Product	= Value ( [/*] Value )*
+Value	= [0-9]+ | '(' Sum ')' | !'0' "x" [a-z]?
+`
+	tree, err := LoadTree(grammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := tree.WriteSentences(&b, "", 20, 1); err != nil {
+		t.Fatal(err)
+	}
+	var once bytes.Buffer
+	tree.WriteSentences(&once, "", 20, 1)
+	if b.String() != once.String() {
+		t.Errorf("sentences differ for the same seed:\n%s\n%s", &b, &once)
+	}
+
+	// Each sentence must be matched by the parsers of the grammar.
+	test := parseTest{name: "sentences", grammar: grammar, rule: "Expr"}
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		s, err := strconv.Unquote(line)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		test.cases = append(test.cases, parseCase{s, fmt.Sprint("ok ", len(s))})
+	}
+	if len(test.cases) != 20 {
+		t.Fatalf("got %d sentences, want 20", len(test.cases))
+	}
+	runParseTests(t, []parseTest{test}, backends)
+
+	if err := tree.WriteSentences(&b, "Missing", 1, 1); err == nil {
+		t.Error("no error for a missing rule")
+	}
+}
+
+func TestRunTests(t *testing.T) {
+	goTool(t)
+	tree, err := LoadTree(`
+Expr	= Num !.
+Num	= [0-9]+ | &{ false } 'x' | 'p' { panic("p") }
+%test Expr "12" ok
+%test Expr "1x" fail 1:2
+%test Expr "x" fail 1:1
+%test Expr "1" fail
+%test Expr "p" ok
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "t.leg")
+	want := strings.ReplaceAll(`t.leg: Expr "1" fail: got ok
+t.leg: Expr "p" ok: got panic: p
+FAIL	t.leg	2 of 5 cases
+`, "t.leg", file)
+
+	// RunTests compiles a copy of the tree, which can thus be
+	// run repeatedly, here with the flags of each backend.
+	for _, b := range backends {
+		var out bytes.Buffer
+		ok, err := tree.ReportTests(&out, file, b.flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok || out.String() != want {
+			t.Errorf("%s: got %v:\n%s\nwant false:\n%s", b.name, ok, &out, want)
+		}
+	}
+}
+
+func TestCover(t *testing.T) {
+	const grammar = `
+Expr	= Sum !.
+Sum	= Product ( [-+] Product )*
+Product	= Value ( [/*] Value )*
+Value	= [0-9]+ | '(' Sum ')'
+`
+	const main = `package main
+
+import (
+	"os"
+	"sync"
+)
+
+func parse(s string) {
+	p := &yyParser{Buffer: s}
+	p.Init()
+	p.Parse(ruleExpr)
+	p.Release()
+}
+
+func main() {
+	inputs := []string{"1+2*3", "(1+2)*34", "1+"}
+	for _, s := range inputs {
+		parse(s)
+	}
+	once := yyCoverCounts
+	yyCoverCounts = [len(yyCoverCounts)]uint64{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				for _, s := range inputs {
+					parse(s)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for i, n := range once {
+		if yyCoverCounts[i] != 800*n {
+			println("counter", i, ":", yyCoverCounts[i], "!=", 800*n)
+		}
+	}
+
+	yyCoverCounts = [len(yyCoverCounts)]uint64{}
+	parse("1+")
+	writeCoverProfile(os.Stdout)
+}
+`
+	tree, err := LoadTree(grammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Define("package", "main")
+	tree.Define("cover", "1")
+	tree.Define("noexport", "1")
+	var parser bytes.Buffer
+	tree.Compile(&parser, "")
+	profile := strings.Join(goRun(t, "cover", parser.String(), main), "\n")
+
+	// The report is based on a tree that has not been compiled, as
+	// by option -coverreport. Repeating the failed parse to find the
+	// rules at the failure must not be counted.
+	tree, err = LoadTree(grammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := tree.WriteCoverReport(&b, grammar, strings.NewReader(profile)); err != nil {
+		t.Fatalf("%v\n%s", err, profile)
+	}
+	const want = `# coverage: 55.6% of 9 points matched
+
+«0»Expr	= Sum !.
+«1»Sum	= Product ( «0»[-+] Product )*
+«1»Product	= Value ( «0»[/*] Value )*
+«1»Value	= «1»«1»[0-9]+ | «0»'(' Sum ')'
+`
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", &b, want)
+	}
+}
+
+func TestCut(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name: "cut",
+			grammar: `
+S	= Item+ !.
+Item	= '(' ~ [a-z]+ ')' | '(' [0-9]+ ')' | [a-z]
+`,
+			rule: "S",
+			cases: []parseCase{
+				{"(ab)", "ok 4"},
+				{"x(ab)y", "ok 6"},
+				{"(1)", "1:2: unexpected character '1' [S Item]"},
+				{"(ab", "1:4: unexpected end of file [S Item]"},
+				// Item+ has matched "a", but the failure after the cut is final.
+				{"a(1)", "1:3: unexpected character '1' [S Item]"},
+				{"a1", "1:2: unexpected character '1' [S Item]"},
+			},
+		},
+		{
+			name: "cut in a nested choice",
+			grammar: `
+S	= ( 'a' ~ 'b' | 'a' 'c' ) 'd' | 'a' 'c' 'e'
+`,
+			rule: "S",
+			cases: []parseCase{
+				{"abd", "ok 3"},
+				// Neither the nested, nor the outer alternative are tried.
+				{"ace", "1:2: unexpected character 'c' [S]"},
+				{"abe", "1:3: unexpected character 'e' [S]"},
+			},
+		},
+		{
+			name: "cut and commit",
+			grammar: `
+S	= 'a' commit 'b' ~ 'c' | 'a' 'b' 'd'
+`,
+			rule: "S",
+			cases: []parseCase{
+				{"abc", "ok 3"},
+				{"abd", "1:3: unexpected character 'd' [S]"},
+				{"ad", "1:2: unexpected character 'd' [S]"},
+			},
+		},
+	}, backends)
+}
+
+func TestKeywords(t *testing.T) {
+	runParseTests(t, []parseTest{
+		{
+			name: "keywords",
+			grammar: `
+S	= - Stmt+ !.
+Stmt	= ` + "`if`" + ` - Ident - Stmt ( ` + "`else`" + ` - Stmt )?
+	| Ident - '=' - Ident -
+	| 'do' -
+Word	= [a-z_][a-z_0-9]*
+-	= ' '*
+%keywords Ident Word 'if' 'else' 'do'
+`,
+			rule: "S",
+			cases: []parseCase{
+				{"if a b = c", "ok 10"},
+				{"iffy = b", "ok 8"},
+				{"if a x = y else b = c", "ok 21"},
+				{"if a x = y elsewhere = c", "ok 24"},
+				{"if = b", "1:4: unexpected character '=' [S Stmt -]"},
+				{"else = b", "1:5: unexpected character ' ' [S Stmt Ident Word]"},
+				// A string literal matches the beginning of a word.
+				{"dox = y", "ok 7"},
+				{"do = y", "1:4: unexpected character '=' [S Stmt -]"},
+			},
+		},
+	}, backends)
+
+	tree := New(false, false)
+	for _, err := range []error{
+		tree.AddDefinition("S", Seq(Keyword("if"), Ref("Ident"), Keyword("then"))),
+		tree.AddKeywordSet("Ident", "Word", "if"),
+		tree.AddDefinition("Word", Plus(Class("a-z"))),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := Format(tree.Rule("S")), "S <- (`if` Ident `then`)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	var messages []string
+	for _, d := range tree.Check() {
+		messages = append(messages, d.Message)
+	}
+	if got, want := strings.Join(messages, "; "), "keyword 'then' not declared using %keywords"; got != want {
+		t.Errorf("got diagnostics %q, want %q", got, want)
+	}
+}
+
+func TestTries(t *testing.T) {
+	tries := []backend{
+		{name: "tries bytes", flags: "t", allRules: true, bytes: true},
+	}
+	for _, b := range backends {
+		b.name += ", tries"
+		b.flags += ":t"
+		tries = append(tries, b)
+	}
+	tree, err := LoadTree("package p\ntype P Peg {}\nName <- 'am' / 'amp' / 'lt' / 'gt'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	tree.Compile(&b, "t")
+	if !strings.Contains(b.String(), "p.matchTrie0()") {
+		t.Errorf("no trie generated:\n%s", &b)
+	}
+	runParseTests(t, []parseTest{
+		{
+			name: "first literal",
+			grammar: `
+S	= Entity+ !.
+Entity	= '&' Name ';'
+Name	= 'am' | 'amp' | 'lt' | 'ltx' | "g" | 'quot' | '\n\t'
+`,
+			rule: "S",
+			cases: []parseCase{
+				{"&am;&lt;&g;&quot;", "ok 17"},
+				{"&\n\t;", "ok 4"},
+				// 'am' is chosen, and not tried again as 'amp'
+				{"&amp;", "1:4: unexpected character 'p' [S Entity]"},
+				{"&ltx;", "1:4: unexpected character 'x' [S Entity]"},
+				// A literal fails at its beginning.
+				{"&qu;", "1:2: unexpected character 'q' [S Entity Name]"},
+				{"&x;", "1:2: unexpected character 'x' [S Entity Name]"},
+				{"&", "1:2: unexpected end of file [S Entity Name]"},
+			},
+		},
+		{
+			name: "longest literal",
+			grammar: `
+S	= Entity+ !.
+Entity	= '&' Name ';'
+Name	= 'am' | 'amp' | 'lt' | 'ltx' | "g" | 'quot' | '\n\t'
+%longest Name
+`,
+			rule: "S",
+			cases: []parseCase{
+				{"&amp;&am;&ltx;&lt;", "ok 18"},
+				{"&amx;", "1:4: unexpected character 'x' [S Entity]"},
+				{"&quo", "1:2: unexpected character 'q' [S Entity Name]"},
+			},
+		},
+	}, tries)
+}
+
+func TestDispatch(t *testing.T) {
+	const grammar = `
+S	= Tok+ !.
+Tok	= [a-z]+ '!' | [a-m] [0-9] | [0-9]+ | '#' Opt | !'~' [^a-z0-9#!] | Rep
+Opt	= 'x' | 'y' | ''
+Rep	= [!]* '~'
+`
+	tree, err := LoadTree(grammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Define("package", "main")
+	tree._switch = true
+	var b bytes.Buffer
+	tree.Compile(&b, "")
+	if !strings.Contains(b.String(), "yyDispatch") {
+		t.Errorf("no dispatch table generated:\n%s", &b)
+	}
+	dispatch := append([]backend{
+		{name: "switch", _switch: true, allRules: true},
+		{name: "switch bytes", inline: true, _switch: true, flags: "all", bytes: true},
+	}, backends...)
+	runParseTests(t, []parseTest{
+		{
+			name:    "dispatch",
+			grammar: grammar,
+			rule:    "S",
+			cases: []parseCase{
+				{"abc!", "ok 4"},
+				{"a1b2", "ok 4"},
+				// 'a' may begin the first two alternatives, which
+				// are tried in order.
+				{"a1z!", "ok 4"},
+				{"12#x#y#", "ok 7"},
+				{"A+ ~!!~", "ok 7"},
+				{"n1", "1:2: unexpected character '1' [S Tok]"},
+				{"a", "1:2: unexpected end of file [S Tok]"},
+				{"!", "1:2: unexpected end of file [S Tok Rep]"},
+				{"#z", "1:3: unexpected end of file [S Tok]"},
+			},
+		},
+	}, dispatch)
+}
+
+func TestSizeReport(t *testing.T) {
+	compile := func(flags string) int {
+		tree, err := LoadTree(`
+S	= A+ !.
+A	= 'x' ( [a-c] [0-9] '-' [d-f] )+ | 'y' ( [a-c] [0-9] '-' [d-f] )+ ';'
+`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.Define("package", "main")
+		var b bytes.Buffer
+		if err := tree.Compile(&b, flags); err != nil {
+			t.Fatal(err)
+		}
+		return b.Len()
+	}
+	unshared := compile("all")
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	log.SetFlags(0)
+	Verbose = true
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+		Verbose = false
+	}()
+	saved := unshared - compile("all:z")
+	if saved <= 0 {
+		t.Errorf("%d bytes saved", saved)
+	}
+	want := fmt.Sprintf("size: 1 helper rules, 0 rules sharing bodies, 0 class tables shared; %d bytes saved\n", saved)
+	if !strings.HasSuffix(logged.String(), want) {
+		t.Errorf("got %q, want %q", logged.String(), want)
+	}
+}
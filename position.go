@@ -0,0 +1,102 @@
+package peg
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Position describes a location within a text. Lines and columns
+// start at 1; columns count runes, like those of the positions
+// reported by generated parsers.
+type Position struct {
+	Offset, Line, Column int
+}
+
+func (pos Position) String() string {
+	return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+}
+
+// PositionOf returns the position of the byte at offset within text.
+func PositionOf(text string, offset int) (pos Position) {
+	if offset > len(text) {
+		offset = len(text)
+	}
+	begin := strings.LastIndexByte(text[:offset], '\n') + 1
+	pos.Offset = offset
+	pos.Line = strings.Count(text[:begin], "\n") + 1
+	pos.Column = 1
+	for range text[begin:offset] {
+		pos.Column++
+	}
+	return
+}
+
+// LineOf returns the line of text containing the byte
+// at offset, without its line terminator.
+func LineOf(text string, offset int) string {
+	if offset > len(text) {
+		offset = len(text)
+	}
+	begin := strings.LastIndexByte(text[:offset], '\n') + 1
+	end := strings.IndexByte(text[offset:], '\n')
+	if end < 0 {
+		end = len(text)
+	} else {
+		end += offset
+	}
+	return strings.TrimSuffix(text[begin:end], "\r")
+}
+
+// Excerpt returns line, followed by a line marking the given column
+// with a caret. Tabs before the column are kept, so that the caret
+// lines up with the character at the column.
+func Excerpt(line string, column int) string {
+	b := []byte(line + "\n")
+	col := 1
+	for _, c := range line {
+		if col == column {
+			break
+		}
+		if c != '\t' {
+			c = ' '
+		}
+		b = append(b, byte(c))
+		col++
+	}
+	return string(append(b, '^'))
+}
+
+// A ParseError describes where, and within which rules, a parse
+// failed. It corresponds to the ParseError of generated parsers.
+type ParseError struct {
+	Position          // the farthest position at which a match failed
+	Rules    []string // the rules active at the failure, outermost first
+	EOF      bool     // the failure occurred at the end of the input
+	Char     rune     // the unexpected character, unless EOF is set
+	line     string   // the line of the input containing the failure
+}
+
+func newParseError(input string, offset int, rules []string) *ParseError {
+	e := &ParseError{Position: PositionOf(input, offset), Rules: rules}
+	e.line = LineOf(input, e.Offset)
+	if e.Offset == len(input) {
+		e.EOF = true
+	} else {
+		e.Char, _ = utf8.DecodeRuneInString(input[e.Offset:])
+	}
+	return e
+}
+
+func (e *ParseError) Error() string {
+	if e.EOF {
+		return fmt.Sprintf("%d:%d: unexpected end of file", e.Line, e.Column)
+	}
+	return fmt.Sprintf("%d:%d: unexpected character %q", e.Line, e.Column, e.Char)
+}
+
+// Excerpt returns the line of the input containing the failure,
+// followed by a line marking its column with a caret.
+func (e *ParseError) Excerpt() string {
+	return Excerpt(e.line, e.Column)
+}
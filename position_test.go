@@ -0,0 +1,46 @@
+package peg
+
+import "testing"
+
+func TestPositionOf(t *testing.T) {
+	const text = "ab\nä€c\r\n\tx"
+	for _, test := range []struct {
+		offset int
+		pos    Position
+		line   string
+	}{
+		{0, Position{0, 1, 1}, "ab"},
+		{2, Position{2, 1, 3}, "ab"},
+		{3, Position{3, 2, 1}, "ä€c"},
+		{5, Position{5, 2, 2}, "ä€c"},
+		{8, Position{8, 2, 3}, "ä€c"},
+		{9, Position{9, 2, 4}, "ä€c"},
+		{12, Position{12, 3, 2}, "\tx"},
+		{13, Position{13, 3, 3}, "\tx"},
+		{20, Position{13, 3, 3}, "\tx"},
+	} {
+		if pos := PositionOf(text, test.offset); pos != test.pos {
+			t.Errorf("PositionOf(%d) = %+v, want %+v", test.offset, pos, test.pos)
+		}
+		if line := LineOf(text, test.offset); line != test.line {
+			t.Errorf("LineOf(%d) = %q, want %q", test.offset, line, test.line)
+		}
+	}
+}
+
+func TestExcerpt(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		column int
+		want   string
+	}{
+		{"abc", 1, "abc\n^"},
+		{"abc", 3, "abc\n  ^"},
+		{"\tä€c", 4, "\tä€c\n\t  ^"},
+		{"ab", 3, "ab\n  ^"},
+	} {
+		if got := Excerpt(test.line, test.column); got != test.want {
+			t.Errorf("Excerpt(%q, %d) = %q, want %q", test.line, test.column, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package peg
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// minSharedWeight is the number of nodes a subexpression must consist
+// of at least to be shared as a helper rule, see optimization flag z.
+const minSharedWeight = 6
+
+// sizeStats collects what the size optimization has shared.
+type sizeStats struct {
+	helpers, bodies, classes int
+}
+
+// A byteCounter counts the bytes written to it.
+type byteCounter int
+
+func (n *byteCounter) Write(b []byte) (int, error) {
+	*n += byteCounter(len(b))
+	return len(b), nil
+}
+
+// unsharedSize returns the number of bytes generated for a copy of t
+// compiled using optiFlags without flag z, which the size of the
+// parser generated with it is compared with.
+func (t *Tree) unsharedSize(optiFlags string) int {
+	var flags []string
+	for _, f := range strings.Split(optiFlags, ":") {
+		if !strings.HasPrefix(f, "z") {
+			flags = append(flags, f)
+		}
+	}
+	verbose, saved := Verbose, stats
+	Verbose = false
+	defer func() {
+		Verbose, stats = verbose, saved
+	}()
+	c := t.clone()
+	c.warnings = new([]string)
+	var n byteCounter
+	c.Compile(&n, strings.Join(flags, ":"))
+	return int(n)
+}
+
+// A subexpression describes an expression that is eligible
+// for sharing, see shareKey.
+type subexpression struct {
+	key    string
+	weight int
+	uses   []use
+}
+
+// A use of a subexpression is either the value of an element of a
+// list, or the values of a run of elements of a sequence seq.
+type use struct {
+	elements []*list.Element
+	seq      *nodeList
+}
+
+// shareKey returns a key that is equal for expressions that match
+// the same, and the number of nodes of the expression. Expressions
+// that contain actions, predicates, commits, cuts, captures or
+// variables depend on their rule and cannot be shared.
+func (t *Tree) shareKey(node Node, keys map[Node]*subexpression) (key string, weight int, ok bool) {
+	if s, seen := keys[node]; seen {
+		if s == nil {
+			return "", 0, false
+		}
+		return s.key, s.weight, true
+	}
+	defer func() {
+		if ok {
+			keys[node] = &subexpression{key: key, weight: weight}
+		} else {
+			keys[node] = nil
+		}
+	}()
+	switch node.GetType() {
+	case TypeName:
+		if node.(*name).varp != nil {
+			return
+		}
+		return fmt.Sprintf("%d %s", TypeName, node), 1, true
+	case TypeKeyword, TypeIdent:
+		k := node.(*keyword)
+		return fmt.Sprintf("%d %d %q", k.Type, k.set.id, k.string), 1, true
+	case TypeCharacter, TypeString, TypeClass:
+		return fmt.Sprintf("%d %q", node.GetType(), node), 1, true
+	case TypeDot, TypeNil:
+		return fmt.Sprint(int(node.GetType())), 1, true
+	case TypeAlternate, TypeSequence,
+		TypePeekFor, TypePeekNot, TypeQuery, TypeStar, TypePlus:
+		return t.listKey(node.GetType(), node.(List).Items(), keys)
+	}
+	return
+}
+
+// listKey returns the key and the weight of a list of the given
+// type consisting of items, see shareKey.
+func (t *Tree) listKey(typ Type, items []Node, keys map[Node]*subexpression) (key string, weight int, ok bool) {
+	parts := []string{fmt.Sprint(int(typ))}
+	weight = 1
+	for _, x := range items {
+		k, w, ok := t.shareKey(x, keys)
+		if !ok {
+			return "", 0, false
+		}
+		parts = append(parts, k)
+		weight += w
+	}
+	return "(" + strings.Join(parts, ", ") + ")", weight, true
+}
+
+// shareSubexpressions replaces subexpressions that occur more than
+// once within the rules, including runs of the items of sequences,
+// by references to helper rules, which are added to the tree. Helper
+// rules are not recorded in the rules reported by parse errors, like
+// rules that have been inlined. Larger subexpressions are shared
+// first.
+func (t *Tree) shareSubexpressions(size *sizeStats) {
+	keys := make(map[Node]*subexpression)
+	byKey := make(map[string]*subexpression)
+	var candidates []*subexpression
+	add := func(key string, weight int, u use) {
+		if weight < minSharedWeight {
+			return
+		}
+		s, ok := byKey[key]
+		if !ok {
+			s = &subexpression{key: key, weight: weight}
+			byKey[key] = s
+			candidates = append(candidates, s)
+		}
+		s.uses = append(s.uses, u)
+	}
+	visited := make(map[Node]bool)
+	var collect func(node Node)
+	collect = func(node Node) {
+		l, ok := node.(List)
+		if !ok || visited[node] {
+			// a leaf expression may be inlined at several places
+			return
+		}
+		visited[node] = true
+		var elements []*list.Element
+		for el := l.front(); el != nil; el = el.Next() {
+			x := el.Value.(Node)
+			collect(x)
+			if _, ok := x.(List); ok {
+				if key, weight, ok := t.shareKey(x, keys); ok {
+					add(key, weight, use{elements: []*list.Element{el}})
+				}
+			}
+			elements = append(elements, el)
+		}
+		if node.GetType() != TypeSequence {
+			return
+		}
+		items := l.Items()
+		for i := range items {
+			for n := 2; i+n <= len(items) && n < len(items); n++ {
+				if key, weight, ok := t.listKey(TypeSequence, items[i:i+n], keys); ok {
+					add(key, weight, use{elements: elements[i : i+n], seq: node.(*nodeList)})
+				}
+			}
+		}
+	}
+	for _, r := range t.Rules() {
+		if t.switchExcl[r.String()] {
+			continue
+		}
+		collect(r.GetExpression())
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].weight > candidates[j].weight
+	})
+
+	// The elements within replaced uses are gone, except those
+	// within the expression of the helper rule.
+	gone := make(map[*list.Element]bool)
+	var remove func(node Node)
+	remove = func(node Node) {
+		if l, ok := node.(List); ok {
+			for el := l.front(); el != nil; el = el.Next() {
+				gone[el] = true
+				remove(el.Value.(Node))
+			}
+		}
+	}
+	for _, s := range candidates {
+		var uses []use
+	next:
+		for _, u := range s.uses {
+			for _, el := range u.elements {
+				if gone[el] {
+					continue next
+				}
+			}
+			uses = append(uses, u)
+		}
+		if len(uses) < 2 {
+			continue
+		}
+		id := t.helperName()
+		h := &rule{name: id, id: t.ruleId, helper: true}
+		t.ruleId++
+		t.rules[id] = h
+		t.ruleList.PushBack(h)
+		t.rulesCount[id] = uint(len(uses))
+		for i, u := range uses {
+			switch {
+			case i > 0:
+				for _, el := range u.elements {
+					remove(el.Value.(Node))
+				}
+			case u.seq == nil:
+				h.expression = u.elements[0].Value.(Node)
+			default:
+				seq := &nodeList{Type: TypeSequence}
+				for _, el := range u.elements {
+					seq.pushBack(el.Value)
+				}
+				h.expression = seq
+			}
+			for _, el := range u.elements {
+				gone[el] = true
+			}
+			u.elements[0].Value = &name{Type: TypeName, string: id}
+			for _, el := range u.elements[1:] {
+				u.seq.remove(el)
+			}
+		}
+		size.helpers++
+	}
+}
+
+// helperName returns a name for a helper rule that
+// does not conflict with the names of other rules.
+func (t *Tree) helperName() string {
+	for i := len(t.rules); ; i++ {
+		if name := "yy" + strconv.Itoa(i); t.rules[name] == nil {
+			return name
+		}
+	}
+}
+
+// shareClasses makes character classes that contain the same
+// characters, like [a-z0-9] and [0-9a-z], share a single table.
+func (t *Tree) shareClasses(size *sizeStats) {
+	var texts []string
+	for text := range t.Classes {
+		texts = append(texts, text)
+	}
+	sort.Slice(texts, func(i, j int) bool {
+		return t.Classes[texts[i]].Index < t.Classes[texts[j]].Index
+	})
+	index := make(map[characterClass]int)
+	for _, text := range texts {
+		e := t.Classes[text]
+		i, ok := index[*e.Class]
+		if ok {
+			size.classes++
+		} else {
+			i = len(index)
+			index[*e.Class] = i
+		}
+		t.Classes[text] = classEntry{i, e.Class}
+	}
+}
+
+// classes returns the entries of the tables of character classes,
+// in the order of their text, omitting entries that share a table.
+func (t *Tree) classes() (entries []classEntry) {
+	var texts []string
+	for text := range t.Classes {
+		texts = append(texts, text)
+	}
+	sort.Strings(texts)
+	seen := make(map[int]bool)
+	for _, text := range texts {
+		if e := t.Classes[text]; !seen[e.Index] {
+			seen[e.Index] = true
+			entries = append(entries, e)
+		}
+	}
+	return
+}
+
+// sharedBodies numbers the bodies, as compiled, of rules that are
+// identical to the body of another rule, and long enough for a shared
+// method to be shorter than the copies. The rules call the method.
+func sharedBodies(rules []*rule, bodies map[*rule]string, size *sizeStats) (shared map[string]int) {
+	uses := make(map[string]int)
+	for _, r := range rules {
+		if body, ok := bodies[r]; ok {
+			uses[body]++
+		}
+	}
+	shared = make(map[string]int)
+	for _, r := range rules {
+		body, ok := bodies[r]
+		if _, done := shared[body]; !ok || done || uses[body] < 2 {
+			continue
+		}
+		n := uses[body]
+		call := len("\n\treturn p.yyBody0()")
+		method := len("\nfunc (p *yyParser) yyBody0() (match bool) {\n}\n")
+		if saved := (n-1)*len(body) - n*call - method; saved > 0 {
+			shared[body] = len(shared)
+			size.bodies += n
+		}
+	}
+	return
+}
@@ -7,17 +7,7 @@ import (
 )
 
 var parserTemplate = strings.Replace(`\
-{{range .Headers}}{{.}}{{end}}\
-{{with def "package"}}\
-package {{.}}
-
-import (
-	"fmt"
-	"io"
-
-	"github.com/knieriem/peg"
-)
-{{end}}
+{{header}}
 const (\
 {{range sortedRules}}
 	rule{{.GoString}}{{if not .GetId}} = iota{{end}}{{end}}
@@ -25,247 +15,699 @@ const (\
 
 type {{def "Peg"}} struct {
 	{{def "userstate"}}
-	Buffer string
+	Buffer {{buffer}}
 	Min, Max int
-	rules [{{numRules}}]func() bool
-	commit func(int)bool
-	ResetBuffer	func(string) string
+	*yyState
+}
+
+// yyState holds the variables of a parser that change during a
+// parse. The rules, actions and class tables are shared by all
+// parsers, so that many of them may be active at the same time.
+type yyState struct {
+{{if vm}}\
+	m peg.Machine
+{{else}}\
+	position, thunkPosition, begin, end int
+	thunks []yyThunk
+	trace *yyTrace // set while a failed parse is repeated
+{{end}}\
+	textBegin, textEnd int
+	lines []int // offsets of the line starts found so far
+	lineScan int // the offset up to which lines have been recorded
+{{range $k, $t := valueTypes}}\
+	yy{{$k}} yyStack[{{$t}}]
+{{end}}\
+}
+{{if vm}}
+var yyStatePool = sync.Pool{
+	New: func() interface{} {
+		return new(yyState)
+	},
+}
+{{else}}
+type yyThunk struct {
+	action uint{{actionBits}}
+	begin, end int
+}
+
+var yyStatePool = sync.Pool{
+	New: func() interface{} {
+		return &yyState{thunks: make([]yyThunk, 32)}
+	},
+}
+
+var yyRules [{{numRules}}]func(*{{def "Peg"}}) bool
+{{end}}
+// Init prepares the parser for parsing p.Buffer. The parse state is
+// taken from a pool, if the parser does not own one yet.
+func (p *{{def "Peg"}}) Init() {
+	if p.yyState == nil {
+		p.yyState = yyStatePool.Get().(*yyState)
+	}
+	p.ResetBuffer(p.Buffer)
+}
+
+// Release returns the parse state to the pool, dropping the semantic
+// values it refers to. Init must be called before the parser is used
+// again.
+func (p *{{def "Peg"}}) Release() {
+	if s := p.yyState; s != nil {
+		p.yyState = nil
+{{if vm}}\
+		s.m.Budget = 0
+{{else}}\
+		s.trace = nil
+{{end}}\
+{{range $k, $t := valueTypes}}\
+		s.yy{{$k}}.release()
+{{end}}\
+		yyStatePool.Put(s)
+	}
+}
+{{if vm}}
+func (p *{{def "Peg"}}) ResetBuffer(s string) (old string) {
+	if p.m.Position < len(p.Buffer) {
+		old = p.Buffer[p.m.Position:]
+	}
+	p.Buffer = s
+	p.m.Reset()
+{{range $k, $t := valueTypes}}\
+	p.yy{{$k}}.reset()
+{{end}}\
+	p.lines = append(p.lines[:0], 0)
+	p.lineScan = 0
+	p.Min = 0
+	p.Max = 0
+	return
 }
 
 func (p *{{def "Peg"}}) Parse(ruleId int) (err error) {
-	if p.rules[ruleId]() {
-		// Make sure thunkPosition is 0 (there may be a yyPop action on the stack).
-		p.commit(0)
+	ok := p.m.Run(&yyProgram, ruleId, p.Buffer, (*yyHost)(p))
+	p.Min, p.Max = p.m.Min, p.m.Max
+	if ok {
 		return
 	}
-	return p.parseErr()
+	return p.parseErr(ruleId)
 }
 
-type {{id "e"}}rrPos struct {
-	Line, Pos int
+// setBudget limits the number of steps the parsing machine may
+// execute. If the budget is exhausted, the parser panics.
+func (p *{{def "Peg"}}) setBudget(n int) {
+	p.m.Budget = n
+}
+{{else}}
+func (p *{{def "Peg"}}) ResetBuffer(s {{buffer}}) (old {{buffer}}) {
+	if p.position < len(p.Buffer) {
+		old = p.Buffer[p.position:]
+	}
+	p.Buffer = s
+	p.lines = append(p.lines[:0], 0)
+	p.lineScan = 0
+	p.thunkPosition = 0
+{{range $k, $t := valueTypes}}\
+	p.yy{{$k}}.reset()
+{{end}}\
+	p.position = 0
+	p.Min = 0
+	p.Max = 0
+	p.end = 0
+	return
 }
 
-func	(e *{{id "e"}}rrPos) String() string {
-	return fmt.Sprintf("%d:%d", e.Line, e.Pos)
+func (p *{{def "Peg"}}) Parse(ruleId int) (err error) {
+	if yyRules[ruleId] == nil {
+		return fmt.Errorf("rule %s is undefined, or has been inlined", yyRuleNames[ruleId])
+	}
+	if {{if cuts}}p.run(ruleId){{else}}yyRules[ruleId](p){{end}} {
+		// Make sure thunkPosition is 0 (there may be a yyPop action on the stack).
+		p.commit(0)
+		return
+	}
+	return p.parseErr(ruleId)
+}
+{{end}}
+// A {{id "p"}}osition describes a location within the buffer. Lines
+// and columns start at 1; columns count runes.
+type {{id "p"}}osition struct {
+	Offset, Line, Column int
 }
 
-type {{id "u"}}nexpectedCharError struct {
-	After, At	{{id "e"}}rrPos
-	Char	byte
+// PositionOf returns the position of the byte at offset within
+// p.Buffer. Line starts are recorded incrementally, as the buffer
+// is scanned for the first time, so that looking up the line of
+// an offset takes logarithmic time.
+func (p *{{def "Peg"}}) PositionOf(offset int) (pos {{id "p"}}osition) {
+	if offset > len(p.Buffer) {
+		offset = len(p.Buffer)
+	}
+	for ; p.lineScan < offset; p.lineScan++ {
+		if p.Buffer[p.lineScan] == '\n' {
+			p.lines = append(p.lines, p.lineScan+1)
+		}
+	}
+	i, j := 0, len(p.lines)
+	for i+1 < j {
+		h := int(uint(i+j) >> 1)
+		if p.lines[h] <= offset {
+			i = h
+		} else {
+			j = h
+		}
+	}
+	pos.Offset = offset
+	pos.Line = i + 1
+	pos.Column = 1
+	for range {{if def "bytes"}}string(p.Buffer[p.lines[i]:offset]){{else}}p.Buffer[p.lines[i]:offset]{{end}} {
+		pos.Column++
+	}
+	return
 }
 
-func (e *{{id "u"}}nexpectedCharError) Error() string {
-	return fmt.Sprintf("%v: unexpected character '%c'", &e.At, e.Char)
+// TextSpan returns the positions of the beginning and the end
+// of yytext. It is meant to be called from within actions.
+func (p *{{def "Peg"}}) TextSpan() (begin, end {{id "p"}}osition) {
+	return p.PositionOf(p.textBegin), p.PositionOf(p.textEnd)
 }
 
-type {{id "u"}}nexpectedEOFError struct {
-	After {{id "e"}}rrPos
+// A {{id "p"}}arseError describes where, and within which rules,
+// a parse failed.
+type {{id "p"}}arseError struct {
+	{{id "p"}}osition // the farthest position at which a match failed
+	After    {{id "p"}}osition // the position of the last commit
+	Rules    []string // the rules active at the failure, outermost first
+	EOF      bool     // the failure occurred at the end of the buffer
+	Char     rune     // the unexpected character, unless EOF is set
+	line     string   // the line of the buffer containing the failure
 }
 
-func (e *{{id "u"}}nexpectedEOFError) Error() string {
-	return fmt.Sprintf("%v: unexpected end of file", &e.After)
+func (e *{{id "p"}}arseError) Error() string {
+	if e.EOF {
+		return fmt.Sprintf("%d:%d: unexpected end of file", e.Line, e.Column)
+	}
+	return fmt.Sprintf("%d:%d: unexpected character %q", e.Line, e.Column, e.Char)
 }
 
-func (p *{{def "Peg"}}) parseErr() (err error) {
-	var pos, after {{id "e"}}rrPos
-	pos.Line = 1
-	for i, c := range p.Buffer[0:] {
-		if c == '\n' {
-			pos.Line++
-			pos.Pos = 0
-		} else {
-			pos.Pos++
-		}
-		if i == p.Min {
-			if p.Min != p.Max {
-				after = pos
-			} else {
-				break
-			}
-		} else if i == p.Max {
+// Excerpt returns the line of the buffer containing the failure,
+// followed by a line marking its column with a caret.
+func (e *{{id "p"}}arseError) Excerpt() string {
+	b := []byte(e.line + "\n")
+	col := 1
+	for _, c := range e.line {
+		if col == e.Column {
 			break
 		}
-	}
-	if p.Max >= len(p.Buffer) {
-		if p.Min == p.Max {
-			err = io.EOF
-		} else {
-			err = &{{id "u"}}nexpectedEOFError{after}
+		if c != '\t' {
+			c = ' '
 		}
+		b = append(b, byte(c))
+		col++
+	}
+	return string(append(b, '^'))
+}
+
+func (p *{{def "Peg"}}) parseErr(ruleId int) (err error) {
+	if p.Max >= len(p.Buffer) && p.Min == p.Max {
+		return io.EOF
+	}
+	e := &{{id "p"}}arseError{{"{"}}{{id "p"}}osition: p.PositionOf(p.Max), After: p.PositionOf(p.Min)}
+{{if vm}}\
+	for _, r := range p.m.Trace(&yyProgram, ruleId, p.Buffer, (*yyHost)(p)) {
+{{else}}\
+	for _, r := range p.failedRules(ruleId) {
+{{end}}\
+		e.Rules = append(e.Rules, yyRuleNames[r])
+	}
+	end := e.Offset
+	for end < len(p.Buffer) && p.Buffer[end] != '\n' {
+		end++
+	}
+	e.line = string(p.Buffer[p.lines[e.Line-1]:end])
+	if n := len(e.line); n > 0 && e.line[n-1] == '\r' {
+		e.line = e.line[:n-1]
+	}
+	if e.Offset == len(p.Buffer) {
+		e.EOF = true
 	} else {
-		err = &{{id "u"}}nexpectedCharError{after, pos, p.Buffer[p.Max]}
+		e.Char, _ = utf8.DecodeRune{{if not (def "bytes")}}InString{{end}}(p.Buffer[e.Offset:])
 	}
-	return
+	return e
 }
 
-func (p *{{def "Peg"}}) Init() {
-	var position int
-{{if nvar}}\
-	var yyp int
-	var yy {{def "yystype"}}
-	var yyval = make([]{{def "yystype"}}, 256)
+var yyRuleNames = [...]string{
+{{range sortedRules}}\
+	rule{{.GoString}}: "{{.}}",
+{{end}}\
+}
+{{if not vm}}
+// yyTrace records the rules entered while a failed parse is
+// repeated, to find those active at the farthest failure. It also
+// implements the budget of rule applications set by setBudget.
+type yyTrace struct {
+	max    int // the farthest failure of the first attempt, -1 if not tracing
+	calls  []int
+	rules  []int
+	done   bool
+	budget int // if positive, the number of rule applications left; -1 if exhausted
+}
+
+func (t *yyTrace) check(max int) {
+	if !t.done && max >= t.max {
+		t.rules = append(t.rules[:0], t.calls...)
+		t.done = true
+	}
+}
+
+func (t *yyTrace) enter(max, rule int) {
+	t.check(max)
+	t.calls = append(t.calls, rule)
+	t.step()
+}
+
+// step counts the application of a rule against the budget.
+// Inlined rules call it directly.
+func (t *yyTrace) step() {
+	switch {
+	case t.budget > 0:
+		if t.budget--; t.budget == 0 {
+			t.budget = -1
+		}
+	case t.budget < 0:
+		panic("budget of rule applications exhausted")
+	}
+}
+
+func (t *yyTrace) leave(max int) {
+	t.check(max)
+	t.calls = t.calls[:len(t.calls)-1]
+}
+
+// failedRules repeats a failed parse, without executing actions,
+// and returns the rules that were active at the farthest failure.
+// Rules that have been inlined are not included.
+func (p *{{def "Peg"}}) failedRules(ruleId int) []int {
+	position, thunkPosition, min, max, trace := p.position, p.thunkPosition, p.Min, p.Max, p.trace
+	p.trace = &yyTrace{max: max}
+	if trace != nil {
+		p.trace.budget = trace.budget
+	}
+	p.Max = -1 // no failure yet
+	{{if cuts}}p.run(ruleId){{else}}yyRules[ruleId](p){{end}}
+	rules := p.trace.rules
+	p.position, p.thunkPosition, p.Min, p.Max, p.trace = position, thunkPosition, min, max, trace
+	return rules
+}
+
+// setBudget limits the number of rules, including inlined ones,
+// the parser may apply. If the budget is exhausted, the parser panics.
+func (p *{{def "Peg"}}) setBudget(n int) {
+	p.trace = &yyTrace{max: -1, budget: n}
+}
+{{if def "cover"}}
+// yyCoverCounts counts the matches of the rules, of the alternatives,
+// and of the repeated expressions of the grammar. Its elements are
+// accessed atomically, so that parsers may run concurrently.
+var yyCoverCounts [{{numCoverPoints}}]uint64
+
+// cover counts a match of the cover point id. Matches while
+// failedRules repeats a parse are not counted.
+func (p *{{def "Peg"}}) cover(id int) {
+	if p.trace == nil || p.trace.max < 0 {
+		atomic.AddUint64(&yyCoverCounts[id], 1)
+	}
+}
+
+// {{id "w"}}riteCoverProfile writes the counts of matches to w, in the
+// format read by option -coverreport of the parser generators.
+func {{id "w"}}riteCoverProfile(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "peg coverage %d\n", len(yyCoverCounts)); err != nil {
+		return err
+	}
+	for i := range yyCoverCounts {
+		if _, err := fmt.Fprintln(w, atomic.LoadUint64(&yyCoverCounts[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 {{end}}\
+{{end}}
+{{if valueTypes}}\
+type yyStack[T any] struct {
+	yy	T
+	val	[]T
+	p	int
+}
 
+func (s *yyStack[T]) push(count int) {
+	s.p += count
+	if s.p >= len(s.val) {
+		v := make([]T, cap(s.val)+256)
+		copy(v, s.val)
+		s.val = v
+	}
+}
+
+func (s *yyStack[T]) pop(count int) {
+	s.p -= count
+}
+
+func (s *yyStack[T]) set(offset int) {
+	s.val[s.p+offset] = s.yy
+}
+
+// reset empties the stack, which may still contain the frames
+// of a parse that failed after a commit, or has been aborted.
+func (s *yyStack[T]) reset() {
+	s.p = 0
+}
+
+// release empties the stack, and drops the values it refers to,
+// before the parse state is put back into the pool.
+func (s *yyStack[T]) release() {
+	var zero T
+	s.yy = zero
+	for i := range s.val {
+		s.val[i] = zero
+	}
+	s.p = 0
+}
+{{end}}
 {{if .Actions}}\
-	actions := [...]func(string, int){
+func init() {
+	yyActions = [...]func(p *{{def "Peg"}}, yytext {{buffer}}, _ int){
 {{	range .Actions}}		/* {{.GetId}} {{.GetRule}} */
-		func(yytext string, _ int) {
+		func(p *{{def "Peg"}}, yytext {{buffer}}, _ int) {
 {{.Code}}		},
-{{	end}}
-{{	if nvar}}\
-		/* yyPush */
-		func(_ string, count int) {
-			yyp += count
-			if yyp >= len(yyval) {
-				s := make([]{{def "yystype"}}, cap(yyval)+256)
-				copy(s, yyval)
-				yyval = s
-			}
+{{	end}}\
+{{	range $k, $t := valueTypes}}\
+		/* yyPush{{$k}} */
+		func(p *{{def "Peg"}}, _ {{buffer}}, count int) {
+			p.yy{{$k}}.push(count)
 		},
-		/* yyPop */
-		func(_ string, count int) {
-			yyp -= count
+		/* yyPop{{$k}} */
+		func(p *{{def "Peg"}}, _ {{buffer}}, count int) {
+			p.yy{{$k}}.pop(count)
 		},
-		/* yySet */
-		func(_ string, count int) {
-			yyval[yyp+count] = yy
+		/* yySet{{$k}} */
+		func(p *{{def "Peg"}}, _ {{buffer}}, offset int) {
+			p.yy{{$k}}.set(offset)
 		},
+{{	end}}\
 	}
-	const (
-		yyPush = {{len .Actions}} + iota
-		yyPop
-		yySet
-	)
-{{	else}}\
+}
+
+var yyActions [{{numActions}}]func(*{{def "Peg"}}, {{buffer}}, int)
+{{	with valueTypes}}
+const (
+{{		range $k, $t := .}}\
+	yyPush{{$k}}{{if not $k}} = {{len $.Actions}} + iota{{end}}
+	yyPop{{$k}}
+	yySet{{$k}}
+{{		end}}\
+)
+{{	end}}
+{{end}}\
+{{with vm}}\
+// yyHost lets the parsing machine execute actions and predicates.
+type yyHost {{def "Peg"}}
+
+func (h *yyHost) Do(action int, yytext string, arg int) {
+{{if $.Actions}}\
+	h.textBegin, h.textEnd = arg, arg+len(yytext)
+	yyActions[action]((*{{def "Peg"}})(h), yytext, arg)
+{{end}}\
+}
+
+func (h *yyHost) Predicate(id int) bool {
+{{if .Predicates}}\
+	return yyPredicates[id]((*{{def "Peg"}})(h))
+{{else}}\
+	return true
+{{end}}\
+}
+{{if .Predicates}}
+func init() {
+	yyPredicates = [...]func(p *{{def "Peg"}}) bool{
+{{range $i, $pred := .Predicates}}\
+		/* {{$i}} */
+		func(p *{{def "Peg"}}) bool {
+			return ({{$pred}})
+		},
+{{end}}\
 	}
-{{	end}}\
-{{	with $bits := actionBits}}
-	type thunk struct {
-		action uint{{$bits}}
-		begin, end int
-	}
-	var thunkPosition, begin, end int
-	thunks := make([]thunk, 32)
-	doarg := func(action uint{{$bits}}, arg int) {
-		if thunkPosition == len(thunks) {
-			newThunks := make([]thunk, 2*len(thunks))
-			copy(newThunks, thunks)
-			thunks = newThunks
-		}
-		t := &thunks[thunkPosition]
-		thunkPosition++
-		t.action = action
-		if arg != 0 {
-			t.begin = arg // use begin to store an argument
-		} else {
-			t.begin = begin
-		}
-		t.end = end
+}
+
+var yyPredicates [{{len .Predicates}}]func(*{{def "Peg"}}) bool
+{{end}}
+var yyProgram = peg.Program{
+{{else}}\
+func (p *{{def "Peg"}}) doarg(action uint{{actionBits}}, arg int) {
+	if p.thunkPosition == len(p.thunks) {
+		newThunks := make([]yyThunk, 2*len(p.thunks))
+		copy(newThunks, p.thunks)
+		p.thunks = newThunks
 	}
-	do := func(action uint{{$bits}}) {
-		doarg(action, 0)
+	t := &p.thunks[p.thunkPosition]
+	p.thunkPosition++
+	t.action = action
+	if arg != 0 {
+		t.begin = arg // use begin to store an argument
+	} else {
+		t.begin = p.begin
 	}
-{{	end}}
-	p.ResetBuffer = func(s string) (old string) {
-		if position < len(p.Buffer) {
-			old = p.Buffer[position:]
+	t.end = p.end
+}
+
+func (p *{{def "Peg"}}) do(action uint{{actionBits}}) {
+	p.doarg(action, 0)
+}
+
+func (p *{{def "Peg"}}) commit(thunkPosition0 int) bool {
+	if thunkPosition0 == 0 {
+{{if .Actions}}\
+		var s {{buffer}}
+		thunks := p.thunks[:p.thunkPosition]
+		if p.trace != nil && p.trace.max >= 0 {
+			thunks = nil // actions are not executed while tracing
 		}
-		p.Buffer = s
-		thunkPosition = 0
-		position = 0
-		p.Min = 0
-		p.Max = 0
-		end = 0
-		return
+		for _, t := range thunks {
+			b := t.begin
+			if b >= 0 && b <= t.end {
+				s = p.Buffer[b:t.end]
+			}
+			p.textBegin, p.textEnd = b, t.end
+			magic := b
+			yyActions[t.action](p, s, magic)
+		}
+{{end}}\
+		p.Min = p.position
+		p.thunkPosition = 0
+		return true
 	}
-{{	if hasCommit}}
-	p.commit = func(thunkPosition0 int) bool {
-		if thunkPosition0 == 0 {
-			s := ""
-			for _, t := range thunks[:thunkPosition] {
-				b := t.begin
-				if b >= 0 && b <= t.end {
-					s = p.Buffer[b:t.end]
-				}
-				magic := b
-				actions[t.action](s, magic)
+	return false
+}
+{{if cuts}}
+// yyCut is the value of the panic raised by cutFail.
+type yyCut struct{}
+
+// cutFail aborts the parse, after an expression following
+// a cut has failed.
+func (p *{{def "Peg"}}) cutFail() {
+	panic(yyCut{})
+}
+
+// run applies a rule. If the parse is aborted by cutFail, the
+// match fails, with p.Max the farthest failure after the cut.
+func (p *{{def "Peg"}}) run(ruleId int) (match bool) {
+	position, thunkPosition := p.position, p.thunkPosition
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(yyCut); !ok {
+				panic(e)
 			}
-			p.Min = position
-			thunkPosition = 0
-			return true
+			p.position, p.thunkPosition = position, thunkPosition
 		}
-		return false
+	}()
+	return yyRules[ruleId](p)
+}
+{{end}}\
+{{with dispatchTables}}
+// yyDispatch maps the next byte to the case of a switch
+// that selects the alternatives that may match.
+var yyDispatch = [...]string{
+{{range .}}	{{.}},
+{{end}}\
+}
+{{end}}\
+{{with keywords}}
+// yyKeywords contains the sets of keywords declared using %keywords.
+var yyKeywords = [...]map[string]bool{
+{{range .}}	{{"{"}}{{range $i, $k := .}}{{if $i}}, {{end}}{{printf "%q" $k}}: true{{end}}{{"}"}},
+{{end}}\
+}
+
+// matchKeyword matches kw, if the word rule matches exactly kw,
+// so that a keyword is not matched at the beginning of a longer word.
+func (p *{{def "Peg"}}) matchKeyword(rule int, kw string) bool {
+	position, thunkPosition := p.position, p.thunkPosition
+	next := position + len(kw)
+	if next <= len(p.Buffer) && string(p.Buffer[position:next]) == kw && yyRules[rule](p) && p.position == next {
+		p.thunkPosition = thunkPosition
+		return true
 	}
-{{	end}}\
+	p.position, p.thunkPosition = position, thunkPosition
+	if position >= p.Max {
+		p.Max = position
+	}
+	return false
+}
+
+// matchIdent matches what the word rule matches, unless
+// it is one of the keywords of the given set.
+func (p *{{def "Peg"}}) matchIdent(rule, set int) bool {
+	position, thunkPosition := p.position, p.thunkPosition
+	if yyRules[rule](p) && !yyKeywords[set][string(p.Buffer[position:p.position])] {
+		p.thunkPosition = thunkPosition
+		return true
+	}
+	p.position, p.thunkPosition = position, thunkPosition
+	if position >= p.Max {
+		p.Max = position
+	}
+	return false
+}
 {{end}}\
 {{with stats}}\
-{{if .Match.Dot}}\
-	matchDot := func() bool {
-		if position < len(p.Buffer) {
-			position++
-			return true
-		} else if position >= p.Max {
-			p.Max = position
-		}
-		return false
+{{if or .Switch .Peek.Dot}}
+// fail records a failure at the current position, where a switch
+// statement skips alternatives, or none of them applies, or where
+// the end of the buffer is peeked for.
+func (p *{{def "Peg"}}) fail() bool {
+	if p.position >= p.Max {
+		p.Max = p.position
 	}
-{{end}}
-{{if .Match.Char}}\
-	matchChar := func(c byte) bool {
-		if (position < len(p.Buffer)) && (p.Buffer[position] == c) {
-			position++
-			return true
-		} else if position >= p.Max {
-			p.Max = position
-		}
-		return false
+	return false
+}
+{{end}}\
+{{if .Match.Dot}}
+func (p *{{def "Peg"}}) matchDot() bool {
+	if p.position < len(p.Buffer) {
+		p.position++
+		return true
+	} else if p.position >= p.Max {
+		p.Max = p.position
 	}
-{{end}}
-{{if .Peek.Char}}\
-	peekChar := func(c byte) bool {
-		return position < len(p.Buffer) && p.Buffer[position] == c
+	return false
+}
+{{end}}\
+{{if .Match.Char}}
+func (p *{{def "Peg"}}) matchChar(c byte) bool {
+	if (p.position < len(p.Buffer)) && (p.Buffer[p.position] == c) {
+		p.position++
+		return true
+	} else if p.position >= p.Max {
+		p.Max = p.position
 	}
-{{end}}
-{{if .Match.String}}\
-	matchString := func(s string) bool {
-		length := len(s)
-		next := position + length
-		if (next <= len(p.Buffer)) && p.Buffer[position] == s[0] && (p.Buffer[position:next] == s) {
-			position = next
-			return true
-		} else if position >= p.Max {
-			p.Max = position
-		}
-		return false
+	return false
+}
+{{end}}\
+{{if .Peek.Char}}
+func (p *{{def "Peg"}}) peekChar(c byte) bool {
+	if p.position < len(p.Buffer) && p.Buffer[p.position] == c {
+		return true
+	} else if p.position >= p.Max {
+		p.Max = p.position
 	}
-{{end}}
-{{	if len $.Classes}}\
-	classes := [...][32]uint8{
-{{range $.Classes}}	{{.Index}}:	{{"{"}}{{range $i, $b := .Class}}{{if $i}}, {{end}}{{$b | printf "%d"}}{{end}}{{"}"}},
+	return false
+}
 {{end}}\
+{{if .Match.String}}
+func (p *{{def "Peg"}}) matchString(s string) bool {
+	length := len(s)
+	next := p.position + length
+	if (next <= len(p.Buffer)) && p.Buffer[p.position] == s[0] && ({{if def "bytes"}}string(p.Buffer[p.position:next]){{else}}p.Buffer[p.position:next]{{end}} == s) {
+		p.position = next
+		return true
+	} else if p.position >= p.Max {
+		p.Max = p.position
 	}
-	matchClass := func(class uint) bool {
-		if (position < len(p.Buffer)) &&
-			((classes[class][p.Buffer[position]>>3] & (1 << (p.Buffer[position] & 7))) != 0) {
-			position++
-			return true
-		} else if position >= p.Max {
-			p.Max = position
-		}
-		return false
+	return false
+}
+{{end}}\
+{{	if len $.Classes}}
+var yyClasses = [...][32]uint8{
+{{range classes}}	{{.Index}}:	{{"{"}}{{range $i, $b := .Class}}{{if $i}}, {{end}}{{$b | printf "%d"}}{{end}}{{"}"}},
+{{end}}\
+}
+
+func (p *{{def "Peg"}}) matchClass(class uint) bool {
+	if (p.position < len(p.Buffer)) &&
+		((yyClasses[class][p.Buffer[p.position]>>3] & (1 << (p.Buffer[p.position] & 7))) != 0) {
+		p.position++
+		return true
+	} else if p.position >= p.Max {
+		p.Max = p.position
 	}
-{{if .Peek.Class}}\
-	peekClass := func(class uint) bool {
-		if (position < len(p.Buffer)) &&
-			((classes[class][p.Buffer[position]>>3] & (1 << (p.Buffer[position] & 7))) != 0) {
-			return true
-		}
-		return false
+	return false
+}
+{{if .Peek.Class}}
+func (p *{{def "Peg"}}) peekClass(class uint) bool {
+	if (p.position < len(p.Buffer)) &&
+		((yyClasses[class][p.Buffer[p.position]>>3] & (1 << (p.Buffer[p.position] & 7))) != 0) {
+		return true
+	} else if p.position >= p.Max {
+		p.Max = p.position
 	}
+	return false
+}
+{{end}}\
+{{	end}}\
 {{end}}
-{{	end}}
+func init() {
+	yyRules = [...]func(*{{def "Peg"}}) bool{
+{{end}}\
+`, "\\\n", "", -1)
+
+var fuzzTemplate = strings.Replace(`\
+// Fuzz test for the parser generated from the same grammar.
+
+package {{pkg}}
+
+import "testing"
+
+// yyFuzzSetup, if set, prepares each parser before it is
+// initialized, e.g. by setting up its user state.
+var yyFuzzSetup func(p *{{def "Peg"}})
+
+// yyFuzzBudget limits the work of a parse: the number of rules
+// applied, including inlined ones, or, if the parser has been written
+// for the parsing machine, the number of steps of the machine.
+var yyFuzzBudget = 1 << 20
+
+// FuzzParse applies each rule of the grammar to the input, using
+// the examples, and the inputs of the test cases of the grammar
+// as seeds.
+func FuzzParse(f *testing.F) {
+	for _, s := range []string{
+{{range seeds}}\
+		{{printf "%q" .}},
 {{end}}\
-	p.rules = [...]func() bool{
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		for rule := range yyRuleNames {
+			p := &{{def "Peg"}}{Buffer: {{if def "bytes"}}[]byte(s){{else}}s{{end}}}
+			if yyFuzzSetup != nil {
+				yyFuzzSetup(p)
+			}
+			p.Init()
+			p.setBudget(yyFuzzBudget)
+			p.Parse(rule)
+			p.Release()
+		}
+	})
+}
 `, "\\\n", "", -1)
 
 // used as template function `len'
@@ -279,3 +721,62 @@ func itemLength(item interface{}) (n int, err error) {
 	}
 	return
 }
+
+var testsTemplate = strings.Replace(`\
+// Test cases of the grammar, run by Tree.RunTests.
+
+package {{pkg}}
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestYYCases applies the rule of each test case of the grammar
+// to its input, and writes the results, see yyRunCase, to the
+// file yytests, one per line.
+func TestYYCases(t *testing.T) {
+	f, err := os.Create("yytests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		rule  int
+		input string
+	}{
+{{range tests}}\
+		{rule{{rule .Rule}}, {{printf "%q" .Input}}},
+{{end}}\
+	} {
+		fmt.Fprintln(f, yyRunCase(c.rule, c.input))
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// yyRunCase returns "ok" if the rule matches the whole input,
+// "fail" and the offset of the failure otherwise, or "panic" and
+// the quoted value of a panic, e.g. of an action.
+func yyRunCase(rule int, input string) (result string) {
+	defer func() {
+		if e := recover(); e != nil {
+			result = fmt.Sprintf("panic %q", fmt.Sprint(e))
+		}
+	}()
+	p := &{{def "Peg"}}{Buffer: {{if def "bytes"}}[]byte(input){{else}}input{{end}}}
+	p.Init()
+	defer p.Release()
+	if err := p.Parse(rule); err != nil {
+		return fmt.Sprint("fail ", p.Max)
+	}
+	if p.position != len(p.Buffer) {
+		if p.Max > p.position {
+			return fmt.Sprint("fail ", p.Max)
+		}
+		return fmt.Sprint("fail ", p.position)
+	}
+	return "ok"
+}
+`, "\\\n", "", -1)
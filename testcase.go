@@ -0,0 +1,215 @@
+package peg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+/*
+A TestCase is an input for a rule of the grammar, given like
+`%test Expr "1+2*3" ok' or `%test Expr "1+" fail 1:3'. The rule
+is expected to match the whole input, or, if Fail is set, not to
+match it; if Line is not 0, the failure is expected at Line and
+Column, which count runes, starting at 1.
+*/
+type TestCase struct {
+	Rule         string
+	Input        string
+	Fail         bool
+	Line, Column int
+}
+
+func (c *TestCase) String() string {
+	s := fmt.Sprintf("%s %q ", c.Rule, c.Input)
+	switch {
+	case !c.Fail:
+		s += "ok"
+	case c.Line == 0:
+		s += "fail"
+	default:
+		s += fmt.Sprintf("fail %d:%d", c.Line, c.Column)
+	}
+	return s
+}
+
+// A TestFailure describes a test case whose result differs from
+// the expected one.
+type TestFailure struct {
+	Case         *TestCase
+	Line, Column int    // the position of the failure, if the rule did fail
+	Panic        string // the value of a panic of the parser, if any
+}
+
+func (f *TestFailure) Error() string {
+	got := "ok"
+	switch {
+	case f.Panic != "":
+		got = "panic: " + f.Panic
+	case f.Line != 0:
+		got = fmt.Sprintf("fail %d:%d", f.Line, f.Column)
+	}
+	return fmt.Sprintf("%v: got %s", f.Case, got)
+}
+
+/*
+RunTests runs the test cases of the grammar, and returns the cases
+with unexpected results. A parser is generated from a copy of the
+tree using optiFlags, see Compile, but with rules not inlined, so
+that each rule can be applied. The parser, and a test applying the
+rules of the cases to their inputs, are written into a temporary
+directory within dir, so that imports are resolved as for the
+grammar's own parser, and run using `go test'. A rule does not match
+an input it does not consume completely; the failure is located at
+the farthest position at which a terminal did not match. Actions
+are executed, with the user state of the parser unset; a panic is
+reported as the result of its case.
+*/
+func (t *Tree) RunTests(dir, optiFlags string) (failures []*TestFailure, err error) {
+	for _, c := range t.tests {
+		if _, ok := t.rules[c.Rule]; !ok {
+			return nil, fmt.Errorf("peg: test of unknown rule '%s'", c.Rule)
+		}
+	}
+	if err = t.clone().resolveForMachine(); err != nil {
+		return
+	}
+	c := t.clone()
+	c.inline = false
+	c.warnings = new([]string)
+	if c.defines["package"] == "" && !packageClause.MatchString(strings.Join(c.Headers, "")) {
+		c.Define("package", "main")
+	}
+	var parser, tests bytes.Buffer
+	if err = c.Compile(&parser, optiFlags); err != nil {
+		return
+	}
+	tpl := template.New("tests")
+	tpl.Funcs(template.FuncMap{
+		"def":   func(key string) string { return c.defines[key] },
+		"pkg":   c.packageName,
+		"tests": func() []*TestCase { return c.tests },
+		"rule":  func(name string) string { return c.rules[name].GoString() },
+	})
+	if _, err = tpl.Parse(testsTemplate); err != nil {
+		return
+	}
+	if err = tpl.Execute(&tests, c); err != nil {
+		return
+	}
+
+	tmp, err := os.MkdirTemp(dir, "yytests")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+	for file, b := range map[string]*bytes.Buffer{"parser.go": &parser, "parser_test.go": &tests} {
+		if err = os.WriteFile(filepath.Join(tmp, file), b.Bytes(), 0666); err != nil {
+			return
+		}
+	}
+	goCmd := func(args ...string) ([]byte, error) {
+		cmd := exec.Command("go", args...)
+		cmd.Dir = tmp
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("peg: go %s: %v\n%s", args[0], err, out)
+		}
+		return out, nil
+	}
+	gomod, err := goCmd("env", "GOMOD")
+	if err != nil {
+		return
+	}
+	if s := strings.TrimSpace(string(gomod)); s == "" || s == os.DevNull {
+		// Outside of a module, or in GOPATH mode, which ignores
+		// go.mod; the parsers need generics.
+		if err = os.WriteFile(filepath.Join(tmp, "go.mod"), []byte("module yytests\n\ngo 1.18\n"), 0666); err != nil {
+			return
+		}
+	}
+	if _, err = goCmd("test", "-count=1", "-run", "^TestYYCases$"); err != nil {
+		return
+	}
+	results, err := os.ReadFile(filepath.Join(tmp, "yytests"))
+	if err != nil {
+		return
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(results), "\n"), "\n")
+	for i, c := range t.tests {
+		f := &TestFailure{Case: c}
+		result := strings.SplitN(lines[i], " ", 2)
+		switch result[0] {
+		case "panic":
+			f.Panic, _ = strconv.Unquote(result[1])
+		case "fail":
+			offset, _ := strconv.Atoi(result[1])
+			pos := PositionOf(c.Input, offset)
+			f.Line, f.Column = pos.Line, pos.Column
+		}
+		switch {
+		case f.Panic != "":
+			failures = append(failures, f)
+		case !c.Fail && f.Line == 0:
+		case c.Fail && f.Line != 0 && (c.Line == 0 || c.Line == f.Line && c.Column == f.Column):
+		default:
+			failures = append(failures, f)
+		}
+	}
+	return
+}
+
+// ReportTests runs the test cases of the grammar, see RunTests, within
+// the directory of the grammar file, and writes a line for each
+// failure, and a summary, to w, naming the file. It reports whether
+// all cases have passed.
+func (t *Tree) ReportTests(w io.Writer, file, optiFlags string) (ok bool, err error) {
+	failures, err := t.RunTests(filepath.Dir(file), optiFlags)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range failures {
+		fmt.Fprintf(w, "%s: %v\n", file, f)
+	}
+	if len(failures) != 0 {
+		fmt.Fprintf(w, "FAIL\t%s\t%d of %d cases\n", file, len(failures), len(t.tests))
+		return false, nil
+	}
+	fmt.Fprintf(w, "ok\t%s\t%d cases\n", file, len(t.tests))
+	return true, nil
+}
+
+// resolveForMachine resolves the rules of t, with warnings suppressed,
+// and checks that the grammar can be run by the parsing machine.
+func (t *Tree) resolveForMachine() error {
+	if err := t.checkKeywords(); err != nil {
+		return err
+	}
+	var warnings []string
+	t.warnings = &warnings
+	defer func() { t.warnings = nil }()
+	t.resolve()
+	for _, r := range t.Rules() {
+		if r.GetExpression() == nilNode {
+			return fmt.Errorf("peg: rule '%v' used but not defined", r)
+		}
+	}
+	if len(t.leftRecursive) != 0 {
+		return fmt.Errorf("peg: possible infinite left recursion in rule '%s'", t.leftRecursive[0])
+	}
+	return nil
+}
+
+// nopHost lets the parsing machine run a grammar, ignoring
+// actions, and assuming predicates to succeed.
+type nopHost struct{}
+
+func (nopHost) Do(int, string, int) {}
+func (nopHost) Predicate(int) bool  { return true }
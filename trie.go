@@ -0,0 +1,208 @@
+package peg
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// minTrieLiterals is the number of string literals an ordered
+// choice must consist of at least to be compiled into a trie.
+const minTrieLiterals = 4
+
+// A trie matches the string literals of an ordered choice, like
+// 'amp' / 'lt' / 'gt' / 'quot', using a generated function that
+// inspects each byte of the input only once. As within the choice,
+// the first listed literal that matches wins.
+type trie struct {
+	id       int
+	node     Node     // the alternate
+	literals []string // unescaped
+	root     *trieNode
+}
+
+type trieNode struct {
+	next map[byte]*trieNode
+	end  int // the index of the literal ending here, -1 if none
+	min  int // the minimal index of the literals ending here or below
+}
+
+// SetLongest makes the ordered choices within rule that consist
+// only of string literals choose the longest literal that matches,
+// instead of the first one listed, like the directive `%longest Rule'.
+func (t *Tree) SetLongest(rule string) {
+	t.longest = append(t.longest, rule)
+}
+
+// resolveLongest orders the literals of the choices affected by
+// SetLongest by decreasing length, so that an ordered choice, or
+// a trie, finds the longest literal that matches.
+func (t *Tree) resolveLongest() {
+	for _, name := range t.longest {
+		r, ok := t.rules[name]
+		if !ok || r.GetExpression() == nilNode {
+			t.warnf("rule '%s' of %%longest not defined", name)
+			continue
+		}
+		Walk(r.GetExpression(), func(node Node) {
+			if node.GetType() != TypeAlternate {
+				return
+			}
+			items := node.(List).Items()
+			for _, x := range items {
+				if typ := x.GetType(); typ != TypeCharacter && typ != TypeString {
+					return
+				}
+			}
+			sort.SliceStable(items, func(i, j int) bool {
+				return len(unescape(items[i].String())) > len(unescape(items[j].String()))
+			})
+			node.(List).init()
+			for _, x := range items {
+				node.(List).pushBack(x)
+			}
+		})
+	}
+}
+
+// findTries looks for alternates consisting only of string literals,
+// which are compiled into tries, see trie.
+func (t *Tree) findTries() {
+	t.tries = nil
+	for _, r := range t.Rules() {
+		Walk(r.GetExpression(), func(node Node) {
+			if node.GetType() != TypeAlternate || node.(List).Len() < minTrieLiterals {
+				return
+			}
+			var literals []string
+			for _, x := range node.(List).Items() {
+				switch x.GetType() {
+				case TypeCharacter, TypeString:
+					if s := unescape(x.String()); s != "" {
+						literals = append(literals, s)
+						continue
+					}
+				}
+				return
+			}
+			t.tries = append(t.tries, newTrie(len(t.tries), node, literals))
+		})
+	}
+}
+
+func newTrie(id int, node Node, literals []string) *trie {
+	tr := &trie{id: id, node: node, literals: literals, root: &trieNode{end: -1, min: 0}}
+	for i, s := range literals {
+		n := tr.root
+		for j := 0; j < len(s); j++ {
+			next, ok := n.next[s[j]]
+			if !ok {
+				if n.next == nil {
+					n.next = make(map[byte]*trieNode)
+				}
+				next = &trieNode{end: -1, min: i}
+				n.next[s[j]] = next
+			}
+			n = next
+		}
+		if n.end == -1 {
+			n.end = i
+		}
+	}
+	return tr
+}
+
+// trie returns the trie an alternate is compiled into, or nil.
+func (t *Tree) trie(node Node) *trie {
+	for _, tr := range t.tries {
+		if tr.node == node {
+			return tr
+		}
+	}
+	return nil
+}
+
+// children returns the bytes leading to nodes that may contain
+// a literal with an index lower than best, in ascending order.
+func (n *trieNode) children(best int) (bytes []byte) {
+	for b, next := range n.next {
+		if next.min < best {
+			bytes = append(bytes, b)
+		}
+	}
+	sort.Slice(bytes, func(i, j int) bool { return bytes[i] < bytes[j] })
+	return
+}
+
+// writeTries writes the methods matching the tries of the grammar.
+func (t *Tree) writeTries(w io.Writer) {
+	parser := t.defines["Peg"]
+	for _, tr := range t.tries {
+		var b strings.Builder
+		writeNode(&b, tr.node)
+		fmt.Fprintf(w, "\n// matchTrie%d matches the first of the literals of %s.\n", tr.id, b.String())
+		fmt.Fprintf(w, "func (p *%s) matchTrie%d() bool {\n", parser, tr.id)
+		fmt.Fprintf(w, "\ts, k, n := p.Buffer[p.position:], -1, 0\n")
+		tr.write(w, tr.root, 0, len(tr.literals), "\t")
+		fmt.Fprintf(w, "\tif k != 0 && p.position >= p.Max {\n")
+		fmt.Fprintf(w, "\t\tp.Max = p.position\n")
+		fmt.Fprintf(w, "\t}\n")
+		fmt.Fprintf(w, "\tif k == -1 {\n")
+		fmt.Fprintf(w, "\t\treturn false\n")
+		fmt.Fprintf(w, "\t}\n")
+		fmt.Fprintf(w, "\tp.position += n\n")
+		fmt.Fprintf(w, "\treturn true\n")
+		fmt.Fprintf(w, "}\n")
+	}
+}
+
+// write writes the code matching the literals below n, which
+// is reached after depth bytes. Best is the index of the
+// literal matched so far, literals with higher indices are
+// not considered anymore. Chains of nodes with a single
+// successor are compared as a string.
+func (tr *trie) write(w io.Writer, n *trieNode, depth, best int, indent string) {
+	if n.end != -1 && n.end < best {
+		best = n.end
+		fmt.Fprintf(w, "%sk, n = %d, %d\n", indent, best, depth)
+	}
+	switch bytes := n.children(best); len(bytes) {
+	case 0:
+	case 1:
+		var run []byte
+		for len(bytes) == 1 {
+			run = append(run, bytes[0])
+			n = n.next[bytes[0]]
+			if n.end != -1 && n.end < best {
+				break
+			}
+			bytes = n.children(best)
+		}
+		end := depth + len(run)
+		if len(run) == 1 {
+			fmt.Fprintf(w, "%sif len(s) > %d && s[%d] == %s {\n", indent, depth, depth, byteLit(run[0]))
+		} else {
+			fmt.Fprintf(w, "%sif len(s) >= %d && string(s[%d:%d]) == %q {\n", indent, end, depth, end, run)
+		}
+		tr.write(w, n, end, best, indent+"\t")
+		fmt.Fprintf(w, "%s}\n", indent)
+	default:
+		fmt.Fprintf(w, "%sif len(s) > %d {\n", indent, depth)
+		fmt.Fprintf(w, "%s\tswitch s[%d] {\n", indent, depth)
+		for _, b := range bytes {
+			fmt.Fprintf(w, "%s\tcase %s:\n", indent, byteLit(b))
+			tr.write(w, n.next[b], depth+1, best, indent+"\t\t")
+		}
+		fmt.Fprintf(w, "%s\t}\n", indent)
+		fmt.Fprintf(w, "%s}\n", indent)
+	}
+}
+
+// byteLit returns b as a Go character literal.
+func byteLit(b byte) string {
+	if b >= 0x80 {
+		return fmt.Sprintf("0x%02x", b)
+	}
+	return fmt.Sprintf("%q", rune(b))
+}
@@ -17,6 +17,11 @@ Possible optimizations:
 		Class or Predicate type, or such an element embedded in a
 		expression out of + * ? ! &.
 
+	m	Emit rules as methods of the parser type, which are called
+		directly, instead of as function literals, which are called
+		through the table of rules. As this changes the generated
+		code, the flag is not part of "all"; use "all:m".
+
 	(p)	When doing a peek for Dot, Char, Class, and Predicate,
 		don't modify position so that it doesn't have to be restored.
 
@@ -29,6 +34,19 @@ Possible optimizations:
 	s	if a sequence starts with one or more `!Char'
 		(PeekNot for Character), insert a switch expression
 
+	t	Compile ordered choices of at least four string literals
+		into a trie, which is matched by a generated method that
+		looks at each byte of the input only once. The first
+		literal listed that matches is chosen, as before. As this
+		changes the generated code, the flag is not part of "all";
+		use "all:t".
+
+	z	Reduce the size of the generated code: subexpressions that
+		occur more than once are shared as helper rules, character
+		classes containing the same characters share a table, and
+		rules with identical bodies share a method. As calls are
+		added, this flag is not part of "all"; use "all:z".
+
 Flags that are shown within braces are less effective now than they used
 to be, probably because of improvements of the Go compilers.
 */
@@ -40,16 +58,22 @@ type optiFlags struct {
 	peek               bool
 	elimRestore        bool
 	inlineLeafs        bool
+	methods            bool
 	seqPeekNot         bool
+	tries              bool
+	size               bool
 	unorderedFirstItem bool
 }
 
 func parseOptiFlags(flags string) (o *optiFlags) {
 	o = new(optiFlags)
-	if flags == "all" {
-		flags = AllOptimizations
+	list := strings.Split(flags, ":")
+	for i, f := range list {
+		if f == "all" {
+			list[i] = AllOptimizations
+		}
 	}
-	for _, f := range strings.Split(flags, ":") {
+	for _, f := range strings.Split(strings.Join(list, ":"), ":") {
 		if len(f) == 0 {
 			continue
 		}
@@ -62,9 +86,69 @@ func parseOptiFlags(flags string) (o *optiFlags) {
 			o.elimRestore = true
 		case 'l':
 			o.inlineLeafs = true
+		case 'm':
+			o.methods = true
 		case 's':
 			o.seqPeekNot = true
+		case 't':
+			o.tries = true
+		case 'z':
+			o.size = true
 		}
 	}
 	return
 }
+
+// unescape interprets the escape sequences of a string
+// literal as written within a grammar.
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b = append(b, c)
+			continue
+		}
+		i++
+		switch c = s[i]; c {
+		case 'a':
+			c = '\a' /* bel */
+		case 'b':
+			c = '\b' /* bs */
+		case 'e':
+			c = '\033' /* esc */
+		case 'f':
+			c = '\f' /* ff */
+		case 'n':
+			c = '\n' /* nl */
+		case 'r':
+			c = '\r' /* cr */
+		case 't':
+			c = '\t' /* ht */
+		case 'v':
+			c = '\v' /* vt */
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			c -= '0'
+			for n := 1; n < 3 && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '7'; n++ {
+				i++
+				c = c*8 + s[i] - '0'
+			}
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+// escape returns s as the contents of a literal within a grammar,
+// which Tree.AddString accepts: a character literal if s is a
+// single byte, otherwise a string literal.
+func escape(s string) string {
+	quote := `"`
+	if len(s) == 1 {
+		quote = "'"
+	}
+	return strings.NewReplacer(`\`, `\\`, quote, `\`+quote).Replace(s)
+}
@@ -0,0 +1,382 @@
+package peg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// vmProgram is a grammar compiled for the parsing machine,
+// together with the information needed to write it as Go code.
+type vmProgram struct {
+	Program
+	Predicates []string
+	comments   map[int]string // rule names at their entry addresses
+}
+
+var opNames = [...]string{
+	OpFail:          "OpFail",
+	OpAny:           "OpAny",
+	OpChar:          "OpChar",
+	OpSet:           "OpSet",
+	OpString:        "OpString",
+	OpCall:          "OpCall",
+	OpReturn:        "OpReturn",
+	OpJump:          "OpJump",
+	OpChoice:        "OpChoice",
+	OpCommit:        "OpCommit",
+	OpPartialCommit: "OpPartialCommit",
+	OpBackCommit:    "OpBackCommit",
+	OpFailTwice:     "OpFailTwice",
+	OpBegin:         "OpBegin",
+	OpEnd:           "OpEnd",
+	OpDo:            "OpDo",
+	OpDoArg:         "OpDoArg",
+	OpPredicate:     "OpPredicate",
+	OpThunks:        "OpThunks",
+	OpPosition:      "OpPosition",
+	OpCut:           "OpCut",
+	OpCutEnd:        "OpCutEnd",
+	OpKeyword:       "OpKeyword",
+	OpIdent:         "OpIdent",
+}
+
+/*
+CompileVM is an alternative backend to Compile. Instead of
+Go functions for each rule, it writes a Program for the parsing
+machine implemented in this package, which usually results in a
+much smaller, and faster compiling, source file. Actions, predicates,
+and semantic values are handled the same way as by Compile.
+Input of type []byte, and coverage mode are not supported; for them,
+and like Compile for the first error found in the grammar, an error
+is returned, and nothing is written.
+*/
+func (t *Tree) CompileVM(out io.Writer) error {
+	if t.defines["bytes"] != "" {
+		return errors.New("peg: []byte input is not supported by the parsing machine")
+	}
+	if t.defines["cover"] != "" {
+		return errors.New("peg: coverage mode is not supported by the parsing machine")
+	}
+	t.resolve()
+	if t.err != nil {
+		return t.err
+	}
+	vm := t.compileProgram(false)
+	w := bufio.NewWriter(out)
+	t.writeParser(w, vm)
+	vm.write(w)
+	for _, s := range t.trailers {
+		fmt.Fprintf(w, "%s", s)
+	}
+	return w.Flush()
+}
+
+// compileProgram translates the grammar into a program for the
+// parsing machine. If captures is set, actions and semantic values
+// are ignored, and `commit' has no effect; instead, each rule records
+// thunks at its beginning and end (actions 2*id and 2*id+1), which
+// can be used to build a parse tree.
+func (t *Tree) compileProgram(captures bool) *vmProgram {
+	vm := &vmProgram{comments: make(map[int]string)}
+	p := &vm.Program
+	p.Rules = make([]int, len(t.rules))
+	p.Classes = make([][32]uint8, len(t.Classes))
+	for _, e := range t.Classes {
+		p.Classes[e.Index] = *e.Class
+	}
+	for _, set := range t.keywords {
+		p.Keywords = append(p.Keywords, set.sorted())
+	}
+	strs := make(map[string]int)
+	str := func(s string) int {
+		i, ok := strs[s]
+		if !ok {
+			i = len(p.Strings)
+			strs[s] = i
+			p.Strings = append(p.Strings, s)
+		}
+		return i
+	}
+	preds := make(map[string]int)
+	var calls []int
+
+	emit := func(i Inst) int {
+		p.Code = append(p.Code, i)
+		return len(p.Code) - 1
+	}
+	// patch sets the target of the jump at address at
+	// to the next address
+	patch := func(at int) {
+		p.Code[at] = p.Code[at].Op() | Inst(len(p.Code))<<8
+	}
+	doarg := func(action, arg int) {
+		emit(OpDoArg | Inst(action)<<8)
+		emit(Inst(uint32(int32(arg) << 8)))
+	}
+	var compile func(node Node)
+	star := func(node Node) {
+		choice := emit(OpChoice)
+		loop := len(p.Code)
+		compile(node)
+		emit(OpPartialCommit | Inst(loop)<<8)
+		patch(choice)
+	}
+	compile = func(node Node) {
+		switch node.GetType() {
+		case TypeDot:
+			emit(OpAny)
+		case TypeCharacter:
+			emit(OpChar | Inst(unescape(node.String())[0])<<8)
+		case TypeString:
+			switch s := unescape(node.String()); len(s) {
+			case 0:
+			case 1:
+				emit(OpChar | Inst(s[0])<<8)
+			default:
+				emit(OpString | Inst(str(s))<<8)
+			}
+		case TypeClass:
+			emit(OpSet | Inst(t.Classes[node.String()].Index)<<8)
+		case TypePredicate:
+			s := node.String()
+			i, ok := preds[s]
+			if !ok {
+				i = len(vm.Predicates)
+				preds[s] = i
+				vm.Predicates = append(vm.Predicates, s)
+			}
+			emit(OpPredicate | Inst(i)<<8)
+		case TypeAction:
+			if !captures {
+				emit(OpDo | Inst(node.(Action).GetId())<<8)
+			}
+		case TypeCommit:
+			if !captures {
+				emit(OpThunks)
+			}
+		case TypeCut:
+		case TypeBegin:
+			emit(OpBegin)
+		case TypeEnd:
+			emit(OpEnd)
+		case TypeNil:
+		case TypeName:
+			rule := t.rules[node.String()]
+			calls = append(calls, emit(OpCall|Inst(rule.id)<<8))
+			if varp := node.(*name).varp; varp != nil && !captures {
+				doarg(len(t.Actions)+3*varp.vtype+2, varp.offset) // yySet
+			}
+		case TypeKeyword, TypeIdent:
+			k := node.(*keyword)
+			choice := emit(OpChoice)
+			if node.GetType() == TypeKeyword {
+				// like &'kw', before the word rule is called
+				peek := emit(OpChoice)
+				if len(k.string) == 1 {
+					emit(OpChar | Inst(k.string[0])<<8)
+				} else {
+					emit(OpString | Inst(str(k.string))<<8)
+				}
+				back := emit(OpBackCommit)
+				patch(peek)
+				emit(OpFail)
+				patch(back)
+			}
+			calls = append(calls, emit(OpCall|Inst(t.rules[k.set.word].id)<<8))
+			if node.GetType() == TypeKeyword {
+				emit(OpKeyword | Inst(str(k.string))<<8)
+			} else {
+				emit(OpIdent | Inst(k.set.id)<<8)
+			}
+			back := emit(OpCommit)
+			patch(choice)
+			emit(OpFail)
+			patch(back)
+		case TypeSequence:
+			cuts := 0
+			for el := node.(List).front(); el != nil; el = el.Next() {
+				if el.Value.(Node).GetType() == TypeCut {
+					if el.Next() != nil {
+						emit(OpCut)
+						cuts++
+					}
+					continue
+				}
+				compile(el.Value.(Node))
+			}
+			for ; cuts > 0; cuts-- {
+				emit(OpCutEnd)
+			}
+		case TypeAlternate, TypeUnorderedAlternate:
+			var commits []int
+			el := node.(List).front()
+			for ; ; el = el.Next() {
+				x := el.Value.(Node)
+				if node.GetType() == TypeUnorderedAlternate {
+					// skip the class used by the switch statement
+					x = x.(List).front().Next().Value.(Node)
+				}
+				if el.Next() == nil {
+					compile(x)
+					break
+				}
+				choice := emit(OpChoice)
+				compile(x)
+				commits = append(commits, emit(OpCommit))
+				patch(choice)
+			}
+			for _, c := range commits {
+				patch(c)
+			}
+		case TypeQuery:
+			choice := emit(OpChoice)
+			compile(node.(List).front().Value.(Node))
+			patch(emit(OpCommit))
+			patch(choice)
+		case TypeStar:
+			star(node.(List).front().Value.(Node))
+		case TypePlus:
+			x := node.(List).front().Value.(Node)
+			compile(x)
+			star(x)
+		case TypePeekNot:
+			choice := emit(OpChoice)
+			compile(node.(List).front().Value.(Node))
+			emit(OpFailTwice)
+			patch(choice)
+		case TypePeekFor:
+			choice := emit(OpChoice)
+			compile(node.(List).front().Value.(Node))
+			back := emit(OpBackCommit)
+			patch(choice)
+			emit(OpFail)
+			patch(back)
+		default:
+			fmt.Fprintf(os.Stderr, "illegal node type: %v\n", node.GetType())
+		}
+	}
+
+	for element := t.ruleList.Front(); element != nil; element = element.Next() {
+		node := element.Value.(Node)
+		if node.GetType() != TypeRule {
+			continue
+		}
+		rule := node.(*rule)
+		if rule.GetExpression() == nilNode {
+			t.warnf("rule '%v' used but not defined", rule)
+			p.Rules[rule.id] = -1
+			continue
+		}
+		if _, ok := t.rulesCount[rule.String()]; !ok {
+			t.warnf("rule '%v' defined but not used", rule)
+		}
+		p.Rules[rule.id] = len(p.Code)
+		vm.comments[len(p.Code)] = fmt.Sprintf("%d %v", rule.id, rule)
+		if captures {
+			emit(OpPosition | Inst(2*rule.id)<<8)
+			compile(rule.GetExpression())
+			emit(OpPosition | Inst(2*rule.id+1)<<8)
+			emit(OpReturn)
+			continue
+		}
+		for k, n := range rule.frame {
+			if n > 0 {
+				doarg(len(t.Actions)+3*k, n) // yyPush
+			}
+		}
+		compile(rule.GetExpression())
+		for k, n := range rule.frame {
+			if n > 0 {
+				doarg(len(t.Actions)+3*k+1, n) // yyPop
+			}
+		}
+		emit(OpReturn)
+	}
+
+	// calls of undefined rules fail
+	for _, at := range calls {
+		if addr := p.Rules[p.Code[at].Arg()]; addr >= 0 {
+			p.Code[at] = OpCall | Inst(addr)<<8
+		} else {
+			p.Code[at] = OpFail
+		}
+	}
+	return vm
+}
+
+// write prints the program as the body of a composite literal
+// of type peg.Program.
+func (vm *vmProgram) write(w io.Writer) {
+	fmt.Fprintf(w, "\tCode: []peg.Inst{")
+	for pc := 0; pc < len(vm.Code); pc++ {
+		if c, ok := vm.comments[pc]; ok {
+			fmt.Fprintf(w, "\n\t\t/* %s */", c)
+		}
+		inst := vm.Code[pc]
+		fmt.Fprintf(w, "\n\t\tpeg.%s", opNames[inst.Op()])
+		switch op := inst.Op(); op {
+		case OpChar:
+			fmt.Fprintf(w, " | %q<<8,", rune(inst.Arg()))
+		case OpString, OpKeyword:
+			fmt.Fprintf(w, " | %d<<8, // %q", inst.Arg(), vm.Strings[inst.Arg()])
+		case OpDoArg:
+			pc++
+			fmt.Fprintf(w, " | %d<<8, %#08x, // %d", inst.Arg(), uint32(vm.Code[pc]), vm.Code[pc].Arg())
+		default:
+			if inst.Arg() != 0 || op == OpSet || op == OpDo || op == OpPredicate || op == OpIdent {
+				fmt.Fprintf(w, " | %d<<8,", inst.Arg())
+			} else {
+				fmt.Fprintf(w, ",")
+			}
+		}
+	}
+	fmt.Fprintf(w, "\n\t},\n\tRules: []int{")
+	for i, addr := range vm.Rules {
+		if i%16 == 0 {
+			fmt.Fprintf(w, "\n\t\t")
+		} else {
+			fmt.Fprintf(w, " ")
+		}
+		fmt.Fprintf(w, "%d,", addr)
+	}
+	fmt.Fprintf(w, "\n\t},\n")
+	if len(vm.Strings) != 0 {
+		fmt.Fprintf(w, "\tStrings: []string{\n")
+		for _, s := range vm.Strings {
+			fmt.Fprintf(w, "\t\t%q,\n", s)
+		}
+		fmt.Fprintf(w, "\t},\n")
+	}
+	if len(vm.Classes) != 0 {
+		fmt.Fprintf(w, "\tClasses: [][32]uint8{\n")
+		for _, c := range vm.Classes {
+			fmt.Fprintf(w, "\t\t{")
+			for i, b := range c {
+				if i != 0 {
+					fmt.Fprintf(w, ", ")
+				}
+				fmt.Fprintf(w, "%d", b)
+			}
+			fmt.Fprintf(w, "},\n")
+		}
+		fmt.Fprintf(w, "\t},\n")
+	}
+	if len(vm.Keywords) != 0 {
+		fmt.Fprintf(w, "\tKeywords: [][]string{\n")
+		for _, set := range vm.Keywords {
+			fmt.Fprintf(w, "\t\t{")
+			for i, kw := range set {
+				if i != 0 {
+					fmt.Fprintf(w, ", ")
+				}
+				fmt.Fprintf(w, "%q", kw)
+			}
+			fmt.Fprintf(w, "},\n")
+		}
+		fmt.Fprintf(w, "\t},\n")
+	}
+	fmt.Fprintf(w, "}\n")
+}